@@ -29,6 +29,7 @@ VERSION:
 COMMANDS:
    start         start the server for the Privytar service
    stop          stop the server for the Privytar service
+   reload        reload the configuration of the server for the Privytar service
 
 GLOBAL OPTIONS:
    --config value, -c value  path to configuration file
@@ -79,6 +80,12 @@ func Run() int {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		}
 
+		return 0
+	case "reload":
+		if err := ReloadAction(*configFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		}
+
 		return 0
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
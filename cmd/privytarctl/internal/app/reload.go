@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+// ErrConfigMismatch is returned when the configuration file given to the
+// reload command isn't the one the server was started with, which is the one
+// it rereads.
+const ErrConfigMismatch xerrors.Error = "configuration file differs from the one the server was started with"
+
+// ReloadAction is the action for the reload command.
+func ReloadAction(configPath string) error {
+	if configPath == "" {
+		return fmt.Errorf("%w", ErrConfigPathRequired)
+	}
+
+	// Validate the configuration before asking the server to reload it, so
+	// mistakes are reported here rather than only in the server's logs.
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	path, err := absolutePath(configPath)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	running, err := os.ReadFile(configRecordPath(cfg.Server.PID))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w", err)
+	}
+
+	// Servers started before the path was recorded can't be checked.
+	if err == nil && string(running) != path {
+		return fmt.Errorf("%w: %s, not %s", ErrConfigMismatch, running, path)
+	}
+
+	process, err := serverProcess(cfg.Server.PID)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if err = process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	fmt.Fprintf(os.Stdout, "validated %s and asked process %d to reload it\n", path, process.Pid)
+
+	return nil
+}
@@ -25,12 +25,22 @@ func StartAction(configPath string) error {
 		return fmt.Errorf("%w", err)
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	level, err := cfg.Server.Level()
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	var (
+		logLevel = &slog.LevelVar{}
+		logger   = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	)
+
+	logLevel.Set(level)
 
 	imgdiet.Start(nil)
 	defer imgdiet.Stop()
 
-	srv, err := server.New(cfg, logger)
+	srv, err := server.New(cfg, logger, logLevel)
 	if err != nil {
 		return fmt.Errorf("%w", err)
 	}
@@ -52,6 +62,17 @@ func StartAction(configPath string) error {
 		return fmt.Errorf("%w", err)
 	}
 
+	// Record the configuration file next to the PID file, so the reload
+	// command can check it validates the file the server rereads.
+	path, err := absolutePath(configPath)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if err = os.WriteFile(configRecordPath(cfg.Server.PID), []byte(path), 0o644); err != nil { //nolint:gosec // not secret
+		return fmt.Errorf("%w", err)
+	}
+
 	if err := srv.Start(); err != nil {
 		return fmt.Errorf("%w", err)
 	}
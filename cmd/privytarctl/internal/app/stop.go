@@ -3,6 +3,7 @@ package app
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -20,28 +21,64 @@ func StopAction(configPath string) error {
 		return fmt.Errorf("%w", err)
 	}
 
-	pidFileData, err := os.ReadFile(cfg.Server.PID)
+	process, err := serverProcess(cfg.Server.PID)
 	if err != nil {
 		return fmt.Errorf("%w", err)
 	}
 
+	if err = process.Signal(os.Interrupt); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if err = os.Remove(cfg.Server.PID); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if err = os.Remove(configRecordPath(cfg.Server.PID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w", err)
+	}
+
+	return nil
+}
+
+// serverProcess returns the running server process recorded in the PID file.
+func serverProcess(pidPath string) (*os.Process, error) {
+	pidFileData, err := os.ReadFile(pidPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
 	pid, err := strconv.Atoi(strings.TrimSpace(string(pidFileData)))
 	if err != nil {
-		return fmt.Errorf("%w", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
 	process, err := os.FindProcess(pid)
 	if err != nil {
-		return fmt.Errorf("%w", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
-	if err = process.Signal(os.Interrupt); err != nil {
-		return fmt.Errorf("%w", err)
+	return process, nil
+}
+
+// configRecordPath returns the path to the file recording the configuration
+// file the server was started with, kept next to its PID file.
+func configRecordPath(pidPath string) string {
+	return pidPath + ".config"
+}
+
+// absolutePath returns the absolute path to a configuration file, with
+// symbolic links resolved, so the same file is always given the same path.
+func absolutePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("%w", err)
 	}
 
-	if err = os.Remove(cfg.Server.PID); err != nil {
-		return fmt.Errorf("%w", err)
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("%w", err)
 	}
 
-	return nil
+	return resolved, nil
 }
@@ -6,16 +6,16 @@ require (
 	git.sr.ht/~jamesponddotco/httpx-go v0.0.0-20230516151239-08a439b40481
 	git.sr.ht/~jamesponddotco/imgdiet-go v0.1.2
 	git.sr.ht/~jamesponddotco/xstd-go v0.4.0
+	github.com/davidbyttow/govips/v2 v2.13.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/image v0.5.0
 	golang.org/x/time v0.3.0
 )
 
 require (
 	git.sr.ht/~jamesponddotco/pagecache-go v0.0.0-20230411150210-54b704d32088 // indirect
 	git.sr.ht/~jamesponddotco/recache-go v1.0.1 // indirect
-	github.com/davidbyttow/govips/v2 v2.13.0 // indirect
 	github.com/stretchr/testify v1.8.0 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
-	golang.org/x/image v0.5.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
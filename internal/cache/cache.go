@@ -1,4 +1,4 @@
-// Package cache provides a simple in-memory backed cache for storing and
+// Package cache provides in-memory and on-disk caches for storing and
 // retrieving images from Gravatar.
 package cache
 
@@ -20,18 +20,201 @@ const (
 
 	// ErrKeyExpired is returned when a key has expired in the cache.
 	ErrKeyExpired xerrors.Error = "key expired"
+
+	// ErrKeyStale is returned along with the value of an expired key that may
+	// still be served while it is refreshed.
+	ErrKeyStale xerrors.Error = "key stale"
+
+	// ErrEntryTooLarge is returned when an entry is larger than the maximum
+	// size allowed by the cache.
+	ErrEntryTooLarge xerrors.Error = "entry is too large for the cache"
 )
 
+// Options defines the limits and expiration time of a cache. A zero limit means
+// the cache isn't bounded by it.
+type Options struct {
+	// Expiration is the expiration time for cache entries, counted from the
+	// time they were added to the cache.
+	Expiration timeutil.CacheDuration
+
+	// StaleWhileRevalidate is how long after expiring an entry may still be
+	// served while it is refreshed in the background.
+	StaleWhileRevalidate timeutil.CacheDuration
+
+	// StaleIfError is how long after expiring an entry may still be served
+	// when refreshing it fails.
+	StaleIfError timeutil.CacheDuration
+
+	// NotFoundExpiration is the expiration time for entries recording that
+	// an image doesn't exist. They are never served stale.
+	NotFoundExpiration timeutil.CacheDuration
+
+	// MaxBytes is the maximum number of bytes the cache can hold.
+	MaxBytes int64
+
+	// MaxEntryBytes is the maximum size in bytes of a single entry.
+	MaxEntryBytes int64
+
+	// Capacity is the maximum number of entries the cache can hold.
+	Capacity uint
+
+	// Now returns the current time, used to date entries and check their
+	// freshness. Nil uses time.Now.
+	Now func() time.Time
+}
+
+// Item represents a value stored in the cache along with its metadata.
+type Item struct {
+	// Modified is the time the item was added to the cache. It is set by the
+	// cache when the item is retrieved and ignored when it is stored.
+	Modified time.Time
+
+	// Expires is the time the item stops being fresh. It is set by the cache
+	// when the item is retrieved and ignored when it is stored.
+	Expires time.Time
+
+	// ContentType is the media type of the value, such as image/png.
+	ContentType string
+
+	// ETag is the entity tag identifying this version of the value.
+	ETag string
+
+	// Value is the content of the item.
+	Value []byte
+
+	// NotFound defines whether the item records that the image doesn't exist
+	// upstream, in which case it has no value and expires after the cache's
+	// not found expiration time.
+	NotFound bool
+}
+
+// Backend is the interface implemented by the storage backends the service can
+// use to cache images.
+type Backend interface {
+	// Get retrieves the item for the given key from the cache.
+	//
+	// The item of an expired entry is still returned while it is within the
+	// cache's stale windows, along with ErrKeyStale if it may be served while
+	// it is refreshed, or ErrKeyExpired if it may only be served when
+	// refreshing it fails.
+	Get(key string) (*Item, error)
+
+	// Set sets the item for the given key in the cache.
+	Set(key string, item *Item) error
+
+	// Delete removes the entry with the given key from the cache.
+	Delete(key string) error
+
+	// SetOptions changes the limits and expiration times of the cache,
+	// evicting the least recently used entries until it fits within the new
+	// limits. Entries already in the cache expire according to the new
+	// expiration times.
+	SetOptions(opts *Options) error
+
+	// Probe checks that the cache can store entries, without changing its
+	// contents.
+	Probe() error
+}
+
+// Compile-time check to ensure Cache implements the Backend interface.
+var _ Backend = (*Cache)(nil)
+
+// lifetime defines how long entries are fresh and how long they are kept
+// after expiring.
+type lifetime struct {
+	// expiration is how long entries are fresh.
+	expiration time.Duration
+
+	// staleWhileRevalidate is how long expired entries are served while they
+	// are refreshed.
+	staleWhileRevalidate time.Duration
+
+	// staleIfError is how long expired entries are served when refreshing
+	// them fails.
+	staleIfError time.Duration
+
+	// notFoundExpiration is how long entries recording that an image doesn't
+	// exist are fresh.
+	notFoundExpiration time.Duration
+
+	// now returns the current time.
+	now func() time.Time
+}
+
+// newLifetime returns the lifetime defined by the given options.
+func newLifetime(opts *Options) lifetime {
+	now := opts.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	return lifetime{
+		expiration:           opts.Expiration.Duration,
+		staleWhileRevalidate: opts.StaleWhileRevalidate.Duration,
+		staleIfError:         opts.StaleIfError.Duration,
+		notFoundExpiration:   opts.NotFoundExpiration.Duration,
+		now:                  now,
+	}
+}
+
+// ttl returns how long an entry is fresh.
+func (l lifetime) ttl(notFound bool) time.Duration {
+	if notFound {
+		return l.notFoundExpiration
+	}
+
+	return l.expiration
+}
+
+// check returns the freshness of an entry added to the cache at the given
+// time, as of the lifetime's clock: nil if it is fresh, ErrKeyStale or
+// ErrKeyExpired as documented in Backend.Get, and keep set to false if it is
+// past every window and should be removed.
+//
+// Entries recording that an image doesn't exist are removed as soon as they
+// expire, so an avatar created upstream shows up without delay.
+func (l lifetime) check(timestamp time.Time, notFound bool) (keep bool, err error) {
+	age := l.now().Sub(timestamp)
+
+	if age <= l.ttl(notFound) {
+		return true, nil
+	}
+
+	if notFound {
+		return false, ErrKeyExpired
+	}
+
+	if age <= l.expiration+l.staleWhileRevalidate {
+		return true, ErrKeyStale
+	}
+
+	if age <= l.expiration+l.staleIfError {
+		return true, ErrKeyExpired
+	}
+
+	return false, ErrKeyExpired
+}
+
 // Entry represents an entry in the cache.
 type Entry struct {
-	// timestamp is the time the entry was added to the cache or last accessed.
+	// timestamp is the time the entry was added to the cache.
 	timestamp time.Time
 
 	// key is the cache key for the entry.
 	key string
 
+	// contentType is the media type of the value.
+	contentType string
+
+	// etag is the entity tag of the value.
+	etag string
+
 	// value is the value of the entry.
 	value []byte
+
+	// notFound defines whether the entry records that the image doesn't
+	// exist.
+	notFound bool
 }
 
 // Cache represents an in-memory LRU cache for Gravatar images.
@@ -45,8 +228,17 @@ type Cache struct {
 	// capacity is the maximum number of entries the cache can hold.
 	capacity uint
 
-	// expiration is the expiration time for cache entries.
-	expiration timeutil.CacheDuration
+	// maxBytes is the maximum number of bytes the cache can hold.
+	maxBytes int64
+
+	// maxEntryBytes is the maximum size in bytes of a single entry.
+	maxEntryBytes int64
+
+	// size is the number of bytes currently stored in the cache.
+	size int64
+
+	// lifetime defines how long cache entries are fresh and kept.
+	lifetime lifetime
 
 	// mu is a read-write mutex to ensure thread safety.
 	mu sync.Mutex
@@ -54,16 +246,26 @@ type Cache struct {
 
 // New creates a new cache with the given capacity and expiration time.
 func New(capacity uint, expiration timeutil.CacheDuration) *Cache {
+	return NewWithOptions(&Options{
+		Capacity:   capacity,
+		Expiration: expiration,
+	})
+}
+
+// NewWithOptions creates a new cache with the given options.
+func NewWithOptions(opts *Options) *Cache {
 	return &Cache{
-		entries:    make(map[string]*list.Element, capacity),
-		list:       list.New(),
-		capacity:   capacity,
-		expiration: expiration,
+		entries:       make(map[string]*list.Element, opts.Capacity),
+		list:          list.New(),
+		capacity:      opts.Capacity,
+		maxBytes:      opts.MaxBytes,
+		maxEntryBytes: opts.MaxEntryBytes,
+		lifetime:      newLifetime(opts),
 	}
 }
 
-// Get retrieves the value for the given key from the cache.
-func (c *Cache) Get(key string) ([]byte, error) { //nolint:unparam // looks like a false positive
+// Get retrieves the item for the given key from the cache.
+func (c *Cache) Get(key string) (*Item, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -77,46 +279,50 @@ func (c *Cache) Get(key string) ([]byte, error) { //nolint:unparam // looks like
 		return nil, ErrTypeAssertion
 	}
 
-	now := time.Now()
-	if now.After(item.timestamp.Add(c.expiration.Duration)) {
-		delete(c.entries, key)
+	keep, err := c.lifetime.check(item.timestamp, item.notFound)
+	if !keep {
+		c.remove(element, item)
 
-		c.list.Remove(element)
-
-		return nil, ErrKeyExpired
+		return nil, err
 	}
 
-	item.timestamp = now
-
 	c.list.MoveToFront(element)
 
-	return item.value, nil
+	return &Item{
+		Modified:    item.timestamp,
+		Expires:     item.timestamp.Add(c.lifetime.ttl(item.notFound)),
+		ContentType: item.contentType,
+		ETag:        item.etag,
+		Value:       item.value,
+		NotFound:    item.notFound,
+	}, err
 }
 
-// Set sets the value for the given key in the cache.
-func (c *Cache) Set(key string, value []byte) error {
+// Set sets the item for the given key in the cache, evicting the least
+// recently used entries until it fits within the cache's limits.
+func (c *Cache) Set(key string, value *Item) error {
+	size := int64(len(value.Value))
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	now := time.Now()
+	if (c.maxEntryBytes > 0 && size > c.maxEntryBytes) || (c.maxBytes > 0 && size > c.maxBytes) {
+		return ErrEntryTooLarge
+	}
 
-	// If the key already exists, update the value and timestamp.
+	// If the key already exists, remove it so it is added back with its new
+	// value and size.
 	if element, ok := c.entries[key]; ok {
 		item, ok := element.Value.(*Entry)
 		if !ok {
 			return ErrTypeAssertion
 		}
 
-		item.value = value
-		item.timestamp = now
-
-		c.list.MoveToFront(element)
-
-		return nil
+		c.remove(element, item)
 	}
 
 	// Evict items if necessary.
-	if c.list.Len() >= int(c.capacity) {
+	for c.list.Len() > 0 && c.overLimit(size) {
 		element := c.list.Back()
 
 		item, ok := element.Value.(*Entry)
@@ -124,21 +330,23 @@ func (c *Cache) Set(key string, value []byte) error {
 			return ErrTypeAssertion
 		}
 
-		delete(c.entries, item.key)
-
-		c.list.Remove(element)
+		c.remove(element, item)
 	}
 
 	// Add the new entry.
 	item := &Entry{
-		timestamp: now,
-		key:       key,
-		value:     value,
+		timestamp:   c.lifetime.now(),
+		key:         key,
+		contentType: value.ContentType,
+		etag:        value.ETag,
+		value:       value.Value,
+		notFound:    value.NotFound,
 	}
 
 	element := c.list.PushFront(item)
 
 	c.entries[key] = element
+	c.size += size
 
 	return nil
 }
@@ -158,9 +366,56 @@ func (c *Cache) Delete(key string) error {
 		return ErrTypeAssertion
 	}
 
-	delete(c.entries, item.key)
+	c.remove(element, item)
 
-	c.list.Remove(element)
+	return nil
+}
+
+// SetOptions changes the limits and expiration times of the cache, evicting
+// the least recently used entries until it fits within the new limits.
+func (c *Cache) SetOptions(opts *Options) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
+	c.capacity = opts.Capacity
+	c.maxBytes = opts.MaxBytes
+	c.maxEntryBytes = opts.MaxEntryBytes
+	c.lifetime = newLifetime(opts)
+
+	for (c.capacity > 0 && uint(c.list.Len()) > c.capacity) || (c.maxBytes > 0 && c.size > c.maxBytes) {
+		element := c.list.Back()
+
+		item, ok := element.Value.(*Entry)
+		if !ok {
+			return ErrTypeAssertion
+		}
+
+		c.remove(element, item)
+	}
+
+	return nil
+}
+
+// Probe checks that the cache can store entries. An in-memory cache always
+// can, so it never fails.
+func (*Cache) Probe() error {
 	return nil
 }
+
+// overLimit reports whether adding an entry of the given size would exceed the
+// cache's capacity or maximum size. The caller must hold the lock.
+func (c *Cache) overLimit(size int64) bool {
+	if c.capacity > 0 && uint(c.list.Len()) >= c.capacity {
+		return true
+	}
+
+	return c.maxBytes > 0 && c.size+size > c.maxBytes
+}
+
+// remove deletes an entry from the cache. The caller must hold the lock.
+func (c *Cache) remove(element *list.Element, item *Entry) {
+	delete(c.entries, item.key)
+
+	c.list.Remove(element)
+	c.size -= int64(len(item.value))
+}
@@ -30,12 +30,12 @@ func TestCache_Set_TypeAssertionError(t *testing.T) {
 
 	c.entries["badKey"] = c.list.PushFront("badType")
 
-	err := c.Set("badKey", []byte("value"))
+	err := c.Set("badKey", &Item{Value: []byte("value")})
 	if !errors.Is(err, ErrTypeAssertion) {
 		t.Errorf("Expected error: %v, got: %v", ErrTypeAssertion, err)
 	}
 
-	err = c.Set("key1", []byte("value1"))
+	err = c.Set("key1", &Item{Value: []byte("value1")})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -47,7 +47,7 @@ func TestCache_Set_TypeAssertionError(t *testing.T) {
 
 	// Add another entry to trigger eviction of the least recently used item
 	// (badKey) This should trigger the second type assertion error.
-	err = c.Set("key2", []byte("value2"))
+	err = c.Set("key2", &Item{Value: []byte("value2")})
 	if !errors.Is(err, ErrTypeAssertion) {
 		t.Errorf("Expected error: %v, got: %v", ErrTypeAssertion, err)
 	}
@@ -3,10 +3,12 @@ package cache_test
 import (
 	"bytes"
 	"errors"
+	"sort"
 	"testing"
 	"time"
 
 	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/testutil"
 	"git.sr.ht/~jamesponddotco/privytar/internal/timeutil"
 )
 
@@ -62,15 +64,22 @@ func TestCache_Get(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			c := cache.New(cacheCapacity, cacheDuration)
+			var (
+				clock = testutil.NewClock()
+				c     = cache.NewWithOptions(&cache.Options{
+					Capacity:   cacheCapacity,
+					Expiration: cacheDuration,
+					Now:        clock.Now,
+				})
+			)
 
 			for key, value := range tt.preloadKeys {
-				_ = c.Set(key, value)
+				_ = c.Set(key, &cache.Item{Value: value})
 			}
 
 			// Manually expire a key if needed
 			if _, ok := tt.preloadKeys["expiredKey"]; ok {
-				time.Sleep(cacheDuration.Duration + 10*time.Millisecond)
+				clock.Advance(cacheDuration.Duration + time.Millisecond)
 			}
 
 			got, err := c.Get(tt.getKey)
@@ -79,13 +88,162 @@ func TestCache_Get(t *testing.T) {
 				return
 			}
 
-			if !bytes.Equal(got, tt.want) {
-				t.Errorf("Cache.Get() = %v, want %v", got, tt.want)
+			if !bytes.Equal(itemValue(got), tt.want) {
+				t.Errorf("Cache.Get() = %v, want %v", itemValue(got), tt.want)
 			}
 		})
 	}
 }
 
+func TestCache_Get_Stale(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		want    []byte
+		wantErr error
+	}{
+		{
+			name: "fresh key",
+			want: []byte("value"),
+		},
+		{
+			name:    "stale while revalidate",
+			wait:    100 * time.Millisecond,
+			want:    []byte("value"),
+			wantErr: cache.ErrKeyStale,
+		},
+		{
+			name:    "stale if error",
+			wait:    200 * time.Millisecond,
+			want:    []byte("value"),
+			wantErr: cache.ErrKeyExpired,
+		},
+		{
+			name:    "past every window",
+			wait:    300 * time.Millisecond,
+			want:    nil,
+			wantErr: cache.ErrKeyExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				clock = testutil.NewClock()
+				c     = cache.NewWithOptions(&cache.Options{
+					Expiration:           timeutil.CacheDuration{Duration: 50 * time.Millisecond},
+					StaleWhileRevalidate: timeutil.CacheDuration{Duration: 100 * time.Millisecond},
+					StaleIfError:         timeutil.CacheDuration{Duration: 200 * time.Millisecond},
+					Now:                  clock.Now,
+				})
+			)
+
+			if err := c.Set("key", &cache.Item{Value: []byte("value")}); err != nil {
+				t.Fatalf("Setup error: %v", err)
+			}
+
+			clock.Advance(tt.wait)
+
+			got, err := c.Get("key")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Cache.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !bytes.Equal(itemValue(got), tt.want) {
+				t.Errorf("Cache.Get() = %v, want %v", itemValue(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestCache_Get_NotFound(t *testing.T) {
+	t.Parallel()
+
+	var (
+		clock = testutil.NewClock()
+		c     = cache.NewWithOptions(&cache.Options{
+			Expiration:           timeutil.CacheDuration{Duration: 1 * time.Hour},
+			StaleWhileRevalidate: timeutil.CacheDuration{Duration: 1 * time.Hour},
+			NotFoundExpiration:   timeutil.CacheDuration{Duration: 50 * time.Millisecond},
+			Now:                  clock.Now,
+		})
+	)
+
+	if err := c.Set("key", &cache.Item{NotFound: true}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	got, err := c.Get("key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !got.NotFound {
+		t.Errorf("Cache.Get() NotFound = false, want true")
+	}
+
+	if want := got.Modified.Add(50 * time.Millisecond); !got.Expires.Equal(want) {
+		t.Errorf("Cache.Get() expiration time = %v, want %v", got.Expires, want)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+
+	// Not found entries are never served stale.
+	got, err = c.Get("key")
+	if !errors.Is(err, cache.ErrKeyExpired) {
+		t.Errorf("Cache.Get() error = %v, wantErr %v", err, cache.ErrKeyExpired)
+	}
+
+	if got != nil {
+		t.Errorf("Cache.Get() = %v, want nil", got)
+	}
+}
+
+func TestCache_Get_Metadata(t *testing.T) {
+	t.Parallel()
+
+	var (
+		c    = cache.New(2, timeutil.CacheDuration{Duration: 1 * time.Hour})
+		item = &cache.Item{
+			ContentType: "image/png",
+			ETag:        `"etag"`,
+			Value:       []byte("value"),
+		}
+		before = time.Now()
+	)
+
+	if err := c.Set("key", item); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	got, err := c.Get("key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got.ContentType != item.ContentType {
+		t.Errorf("Cache.Get() content type = %q, want %q", got.ContentType, item.ContentType)
+	}
+
+	if got.ETag != item.ETag {
+		t.Errorf("Cache.Get() ETag = %q, want %q", got.ETag, item.ETag)
+	}
+
+	if got.Modified.Before(before) {
+		t.Errorf("Cache.Get() modification time = %v, want after %v", got.Modified, before)
+	}
+
+	if want := got.Modified.Add(1 * time.Hour); !got.Expires.Equal(want) {
+		t.Errorf("Cache.Get() expiration time = %v, want %v", got.Expires, want)
+	}
+}
+
 func TestCache_Set(t *testing.T) {
 	t.Parallel()
 
@@ -141,15 +299,23 @@ func TestCache_Set(t *testing.T) {
 
 			c := cache.New(tt.capacity, tt.expiration)
 
-			// Preload initial keys.
-			for key, value := range tt.initialKeys {
-				if err := c.Set(key, value); err != nil {
+			// Preload initial keys in a stable order, so the least recently
+			// used key is predictable.
+			keys := make([]string, 0, len(tt.initialKeys))
+			for key := range tt.initialKeys {
+				keys = append(keys, key)
+			}
+
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				if err := c.Set(key, &cache.Item{Value: tt.initialKeys[key]}); err != nil {
 					t.Fatalf("Setup error: %v", err)
 				}
 			}
 
 			// Call Set method.
-			if err := c.Set(tt.setKey, tt.setValue); (err != nil) != tt.expectErr {
+			if err := c.Set(tt.setKey, &cache.Item{Value: tt.setValue}); (err != nil) != tt.expectErr {
 				t.Errorf("Cache.Set() error = %v, expectErr %v", err, tt.expectErr)
 			}
 
@@ -158,8 +324,8 @@ func TestCache_Set(t *testing.T) {
 			if err != nil {
 				t.Errorf("Failed to retrieve set key: %v", err)
 			}
-			if !bytes.Equal(value, tt.expectedValue) {
-				t.Errorf("Cache.Get() = %v, expected %v", value, tt.expectedValue)
+			if !bytes.Equal(itemValue(value), tt.expectedValue) {
+				t.Errorf("Cache.Get() = %v, expected %v", itemValue(value), tt.expectedValue)
 			}
 
 			// Check if any key was evicted.
@@ -173,6 +339,148 @@ func TestCache_Set(t *testing.T) {
 	}
 }
 
+func TestCache_Set_MaxBytes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		opts        *cache.Options
+		initialKeys []string
+		setKey      string
+		setValue    []byte
+		wantErr     error
+		evictedKeys []string
+		keptKeys    []string
+	}{
+		{
+			name: "Entry fits",
+			opts: &cache.Options{
+				MaxBytes: 16,
+			},
+			initialKeys: []string{"key1"},
+			setKey:      "key2",
+			setValue:    []byte("val2"),
+			keptKeys:    []string{"key1"},
+		},
+		{
+			name: "Evicts until entry fits",
+			opts: &cache.Options{
+				MaxBytes: 11,
+			},
+			initialKeys: []string{"key1", "key2", "key3"},
+			setKey:      "key4",
+			setValue:    []byte("value4"),
+			evictedKeys: []string{"key1", "key2"},
+			keptKeys:    []string{"key3"},
+		},
+		{
+			name: "Overwrite accounts for new size",
+			opts: &cache.Options{
+				MaxBytes: 8,
+			},
+			initialKeys: []string{"key1", "key2"},
+			setKey:      "key2",
+			setValue:    []byte("value2"),
+			evictedKeys: []string{"key1"},
+		},
+		{
+			name: "Entry larger than per-entry maximum",
+			opts: &cache.Options{
+				MaxBytes:      1024,
+				MaxEntryBytes: 4,
+			},
+			initialKeys: []string{"key1"},
+			setKey:      "key2",
+			setValue:    []byte("value2"),
+			wantErr:     cache.ErrEntryTooLarge,
+			keptKeys:    []string{"key1"},
+		},
+		{
+			name: "Entry larger than cache",
+			opts: &cache.Options{
+				MaxBytes: 4,
+			},
+			initialKeys: []string{"key1"},
+			setKey:      "key2",
+			setValue:    []byte("value2"),
+			wantErr:     cache.ErrEntryTooLarge,
+			keptKeys:    []string{"key1"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tt.opts.Expiration = timeutil.CacheDuration{Duration: 5 * time.Minute}
+
+			c := cache.NewWithOptions(tt.opts)
+
+			for _, key := range tt.initialKeys {
+				if err := c.Set(key, &cache.Item{Value: []byte("val")}); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			}
+
+			if err := c.Set(tt.setKey, &cache.Item{Value: tt.setValue}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Cache.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for _, key := range tt.evictedKeys {
+				if _, err := c.Get(key); !errors.Is(err, cache.ErrKeyNotFound) {
+					t.Errorf("Expected key %s to be evicted", key)
+				}
+			}
+
+			for _, key := range tt.keptKeys {
+				if _, err := c.Get(key); err != nil {
+					t.Errorf("Expected key %s to be kept, got: %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_SetOptions(t *testing.T) {
+	t.Parallel()
+
+	c := cache.NewWithOptions(&cache.Options{
+		Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour},
+		Capacity:   3,
+	})
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := c.Set(key, &cache.Item{Value: []byte(key)}); err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+	}
+
+	err := c.SetOptions(&cache.Options{
+		Expiration: timeutil.CacheDuration{Duration: 1 * time.Minute},
+		Capacity:   2,
+	})
+	if err != nil {
+		t.Fatalf("Cache.SetOptions() error = %v", err)
+	}
+
+	// The least recently used entry is evicted to fit the new capacity.
+	if _, err = c.Get("key1"); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Errorf("Cache.Get() error = %v, wantErr %v", err, cache.ErrKeyNotFound)
+	}
+
+	got, err := c.Get("key3")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Entries already in the cache use the new expiration time.
+	if want := got.Modified.Add(1 * time.Minute); !got.Expires.Equal(want) {
+		t.Errorf("Cache.Get() expiration time = %v, want %v", got.Expires, want)
+	}
+}
+
 func TestCache_Delete(t *testing.T) {
 	t.Parallel()
 
@@ -211,7 +519,7 @@ func TestCache_Delete(t *testing.T) {
 
 			c := cache.New(tt.capacity, tt.expiration)
 			for k, v := range tt.preloadKeys {
-				if err := c.Set(k, v); err != nil {
+				if err := c.Set(k, &cache.Item{Value: v}); err != nil {
 					t.Fatalf("Setup error: %v", err)
 				}
 			}
@@ -234,3 +542,12 @@ func TestCache_Delete(t *testing.T) {
 		})
 	}
 }
+
+// itemValue returns the value of the given item, or nil if there is no item.
+func itemValue(item *cache.Item) []byte {
+	if item == nil {
+		return nil
+	}
+
+	return item.Value
+}
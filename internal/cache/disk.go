@@ -0,0 +1,651 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+// ErrInvalidEntry is returned when an entry stored on disk is corrupted or was
+// written by an incompatible version of the service.
+const ErrInvalidEntry xerrors.Error = "invalid cache entry"
+
+const (
+	// _diskMagic identifies files written by the disk cache.
+	_diskMagic string = "PVTR"
+
+	// _diskVersion is the version of the on-disk entry format.
+	_diskVersion byte = 3
+
+	// _diskHeaderSize is the size of the fixed part of an entry header: magic,
+	// version, and metadata length.
+	_diskHeaderSize int = len(_diskMagic) + 1 + 4
+
+	// _diskMaxMetadataSize is the maximum size of the metadata of an entry,
+	// guarding against allocating memory for corrupted headers.
+	_diskMaxMetadataSize uint32 = 64 << 10
+
+	// _diskTempPattern is the pattern used for temporary files written before
+	// being atomically renamed into place.
+	_diskTempPattern string = ".tmp-*"
+
+	// _diskDirMode is the file mode used for cache directories.
+	_diskDirMode fs.FileMode = 0o700
+
+	// _diskFileMode is the file mode used for cache entries.
+	_diskFileMode fs.FileMode = 0o600
+)
+
+// diskMetadata represents the metadata stored in the header of an entry on
+// disk, encoded as JSON.
+type diskMetadata struct {
+	// Key is the cache key for the entry.
+	Key string `json:"key"`
+
+	// ContentType is the media type of the entry's value.
+	ContentType string `json:"contentType,omitempty"`
+
+	// ETag is the entity tag of the entry's value.
+	ETag string `json:"etag,omitempty"`
+
+	// NotFound defines whether the entry records that the image doesn't
+	// exist.
+	NotFound bool `json:"notFound,omitempty"`
+
+	// Timestamp is the time the entry was added to the cache.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// diskEntry represents the in-memory index record of an entry stored on disk.
+type diskEntry struct {
+	// timestamp is the time the entry was added to the cache.
+	timestamp time.Time
+
+	// key is the cache key for the entry.
+	key string
+
+	// path is the location of the entry on disk.
+	path string
+
+	// size is the size of the entry file in bytes.
+	size int64
+
+	// notFound defines whether the entry records that the image doesn't
+	// exist.
+	notFound bool
+}
+
+// DiskCache represents an on-disk LRU cache for Gravatar images that survives
+// restarts of the service.
+//
+// Entries are stored in a sharded directory layout, one file per entry, and
+// are written atomically. The time an entry was added is kept in its header,
+// so expiration survives restarts, and entries reloaded from disk are evicted
+// in the order they were added.
+type DiskCache struct {
+	// entries is a map of cache keys to index records.
+	entries map[string]*list.Element
+
+	// list is a doubly linked list of index records.
+	list *list.List
+
+	// directory is the root directory of the cache.
+	directory string
+
+	// capacity is the maximum number of entries the cache can hold.
+	capacity uint
+
+	// maxBytes is the maximum number of bytes the cache can hold on disk.
+	maxBytes int64
+
+	// maxEntryBytes is the maximum size in bytes of a single entry.
+	maxEntryBytes int64
+
+	// size is the number of bytes currently stored on disk.
+	size int64
+
+	// lifetime defines how long cache entries are fresh and kept.
+	lifetime lifetime
+
+	// mu is a mutex to ensure thread safety.
+	mu sync.Mutex
+}
+
+// Compile-time check to ensure DiskCache implements the Backend interface.
+var _ Backend = (*DiskCache)(nil)
+
+// NewDisk creates a new disk cache rooted at the given directory with the given
+// options. Entries left by a previous run are indexed, and expired or invalid
+// ones are removed.
+//
+// The MaxBytes option accounts for the full size of the files on disk,
+// including the small header stored with each entry.
+func NewDisk(directory string, opts *Options) (*DiskCache, error) {
+	if err := os.MkdirAll(directory, _diskDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	c := &DiskCache{
+		entries:       make(map[string]*list.Element),
+		list:          list.New(),
+		directory:     filepath.Clean(directory),
+		capacity:      opts.Capacity,
+		maxBytes:      opts.MaxBytes,
+		maxEntryBytes: opts.MaxEntryBytes,
+		lifetime:      newLifetime(opts),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("failed to load cache directory: %w", err)
+	}
+
+	return c, nil
+}
+
+// Get retrieves the item for the given key from the cache.
+//
+// The entry is read from disk without holding the lock, so a slow disk doesn't
+// block every other request. Its freshness is checked against the timestamp
+// read along with it, so an entry rewritten in the meantime is returned whole,
+// never with the dates of the entry it replaced.
+func (c *DiskCache) Get(key string) (*Item, error) {
+	entry, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := readEntry(entry.path, key)
+	if err != nil {
+		c.discard(&entry)
+
+		return nil, fmt.Errorf("%w: %w", ErrKeyNotFound, err)
+	}
+
+	c.mu.Lock()
+	lifetime := c.lifetime
+	c.mu.Unlock()
+
+	keep, freshness := lifetime.check(value.Modified, value.NotFound)
+	if !keep {
+		return nil, freshness
+	}
+
+	value.Expires = value.Modified.Add(lifetime.ttl(value.NotFound))
+
+	return value, freshness
+}
+
+// lookup returns a copy of the index record of the entry for the given key and
+// marks it as recently used. Entries past every stale window are removed
+// instead.
+func (c *DiskCache) lookup(key string) (diskEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return diskEntry{}, ErrKeyNotFound
+	}
+
+	item, ok := element.Value.(*diskEntry)
+	if !ok {
+		return diskEntry{}, ErrTypeAssertion
+	}
+
+	if keep, err := c.lifetime.check(item.timestamp, item.notFound); !keep {
+		c.remove(element, item)
+
+		return diskEntry{}, err
+	}
+
+	c.list.MoveToFront(element)
+
+	return *item, nil
+}
+
+// discard removes the entry described by a copy of its index record after it
+// failed to be read, unless it was removed or rewritten in the meantime, in
+// which case its path or timestamp changed.
+func (c *DiskCache) discard(entry *diskEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[entry.key]
+	if !ok {
+		return
+	}
+
+	item, ok := element.Value.(*diskEntry)
+	if !ok || item.path != entry.path || !item.timestamp.Equal(entry.timestamp) {
+		return
+	}
+
+	c.remove(element, item)
+}
+
+// Set sets the item for the given key in the cache.
+func (c *DiskCache) Set(key string, value *Item) error {
+	now := c.now()
+
+	header, err := encodeHeader(&diskMetadata{
+		Key:         key,
+		ContentType: value.ContentType,
+		ETag:        value.ETag,
+		NotFound:    value.NotFound,
+		Timestamp:   now,
+	})
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(header) + len(value.Value))
+
+	if !c.fits(int64(len(value.Value)), size) {
+		return ErrEntryTooLarge
+	}
+
+	path := c.path(key)
+
+	// The entry is written and synced before taking the lock, so a slow disk
+	// doesn't block every other request. Only the rename and the index update
+	// must happen together.
+	temp, err := writeTemp(filepath.Dir(path), header, value.Value)
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = os.Rename(temp, path); err != nil {
+		_ = os.Remove(temp)
+
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+
+	// If the key already exists, update the size and timestamp.
+	if element, ok := c.entries[key]; ok {
+		item, ok := element.Value.(*diskEntry)
+		if !ok {
+			return ErrTypeAssertion
+		}
+
+		c.size += size - item.size
+
+		item.size = size
+		item.timestamp = now
+		item.notFound = value.NotFound
+
+		c.list.MoveToFront(element)
+	} else {
+		item := &diskEntry{
+			timestamp: now,
+			key:       key,
+			path:      path,
+			size:      size,
+			notFound:  value.NotFound,
+		}
+
+		c.entries[key] = c.list.PushFront(item)
+		c.size += size
+	}
+
+	return c.evict()
+}
+
+// fits returns true if an entry with a value and a total size of the given
+// number of bytes fits within the cache's limits.
+func (c *DiskCache) fits(valueSize, size int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxEntryBytes > 0 && valueSize > c.maxEntryBytes {
+		return false
+	}
+
+	return c.maxBytes == 0 || size <= c.maxBytes
+}
+
+// now returns the current time according to the cache's lifetime.
+func (c *DiskCache) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lifetime.now()
+}
+
+// Delete removes the entry with the given key from the cache.
+func (c *DiskCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	item, ok := element.Value.(*diskEntry)
+	if !ok {
+		return ErrTypeAssertion
+	}
+
+	c.remove(element, item)
+
+	return nil
+}
+
+// SetOptions changes the limits and expiration times of the cache, evicting
+// the least recently used entries until it fits within the new limits.
+func (c *DiskCache) SetOptions(opts *Options) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = opts.Capacity
+	c.maxBytes = opts.MaxBytes
+	c.maxEntryBytes = opts.MaxEntryBytes
+	c.lifetime = newLifetime(opts)
+
+	return c.evict()
+}
+
+// Probe checks that the cache directory still exists and is writable by
+// creating and removing a temporary file in it. Entries are left untouched, so
+// probing neither evicts them nor wears the disk much.
+func (c *DiskCache) Probe() error {
+	file, err := os.CreateTemp(c.directory, _diskTempPattern)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+
+		return fmt.Errorf("%w", err)
+	}
+
+	if err = os.Remove(file.Name()); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits within
+// its capacity and maximum size. The caller must hold the lock.
+func (c *DiskCache) evict() error {
+	for (c.capacity > 0 && uint(c.list.Len()) > c.capacity) || (c.maxBytes > 0 && c.size > c.maxBytes) {
+		element := c.list.Back()
+		if element == nil {
+			break
+		}
+
+		item, ok := element.Value.(*diskEntry)
+		if !ok {
+			return ErrTypeAssertion
+		}
+
+		c.remove(element, item)
+	}
+
+	return nil
+}
+
+// remove deletes an entry from the index and from disk. The caller must hold
+// the lock.
+func (c *DiskCache) remove(element *list.Element, item *diskEntry) {
+	delete(c.entries, item.key)
+
+	c.list.Remove(element)
+	c.size -= item.size
+
+	// A file that can't be removed is orphaned until the next load, which
+	// is preferable to failing the request.
+	_ = os.Remove(item.path)
+}
+
+// path returns the location on disk of the entry for the given key. Keys are
+// hashed so any string can be used, and the first bytes of the hash are used
+// to shard entries across directories.
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+
+	return filepath.Join(c.directory, name[0:2], name[2:4], name)
+}
+
+// load walks the cache directory and indexes the entries found in it.
+func (c *DiskCache) load() error {
+	items := make([]*diskEntry, 0)
+
+	err := filepath.WalkDir(c.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		// Temporary files are left behind by writes and probes interrupted by
+		// a crash, at any level of the layout.
+		if matched, _ := filepath.Match(_diskTempPattern, d.Name()); matched {
+			_ = os.Remove(path)
+
+			return nil
+		}
+
+		// Only files inside the sharded layout are considered, so unrelated
+		// files in the directory are never touched.
+		rel, err := filepath.Rel(c.directory, path)
+		if err != nil || len(strings.Split(rel, string(filepath.Separator))) != 3 {
+			return nil //nolint:nilerr // not a cache entry
+		}
+
+		if len(d.Name()) != hex.EncodedLen(sha256.Size) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err //nolint:wrapcheck // wrapped by the caller
+		}
+
+		metadata, err := readMetadata(path)
+		if err != nil || c.path(metadata.Key) != path {
+			_ = os.Remove(path)
+
+			return nil
+		}
+
+		if keep, _ := c.lifetime.check(metadata.Timestamp, metadata.NotFound); !keep {
+			_ = os.Remove(path)
+
+			return nil
+		}
+
+		items = append(items, &diskEntry{
+			timestamp: metadata.Timestamp,
+			key:       metadata.Key,
+			path:      path,
+			size:      info.Size(),
+			notFound:  metadata.NotFound,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	// Most recently used entries go to the front of the list.
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].timestamp.After(items[j].timestamp)
+	})
+
+	for _, item := range items {
+		c.entries[item.key] = c.list.PushBack(item)
+		c.size += item.size
+	}
+
+	return c.evict()
+}
+
+// writeTemp writes an entry to a temporary file in the given directory, synced
+// to disk, and returns its path. The caller renames it into place, so readers
+// never see a partially written entry.
+func writeTemp(dir string, header, value []byte) (path string, err error) {
+	if err = os.MkdirAll(dir, _diskDirMode); err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	file, err := os.CreateTemp(dir, _diskTempPattern)
+	if err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	if err = file.Chmod(_diskFileMode); err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	if _, err = file.Write(header); err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	if _, err = file.Write(value); err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	if err = file.Sync(); err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	if err = file.Close(); err != nil {
+		return "", fmt.Errorf("%w", err)
+	}
+
+	return file.Name(), nil
+}
+
+// readEntry reads the item stored at the given path, ensuring it belongs to
+// the given key.
+func readEntry(path, key string) (*Item, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	metadata, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Key != key {
+		return nil, fmt.Errorf("%w: key mismatch", ErrInvalidEntry)
+	}
+
+	value, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return &Item{
+		ContentType: metadata.ContentType,
+		ETag:        metadata.ETag,
+		Value:       value,
+		Modified:    metadata.Timestamp,
+		NotFound:    metadata.NotFound,
+	}, nil
+}
+
+// readMetadata returns the metadata of the entry stored at the given path.
+func readMetadata(path string) (*diskMetadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer file.Close()
+
+	return readHeader(bufio.NewReader(file))
+}
+
+// encodeHeader returns the header of an entry with the given metadata.
+func encodeHeader(metadata *diskMetadata) ([]byte, error) {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEntry, err)
+	}
+
+	if len(encoded) > int(_diskMaxMetadataSize) {
+		return nil, fmt.Errorf("%w: metadata is too large", ErrInvalidEntry)
+	}
+
+	header := make([]byte, 0, _diskHeaderSize+len(encoded))
+	header = append(header, _diskMagic...)
+	header = append(header, _diskVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(encoded)))
+	header = append(header, encoded...)
+
+	return header, nil
+}
+
+// readHeader reads and validates an entry header, returning the metadata it
+// holds.
+func readHeader(r io.Reader) (*diskMetadata, error) {
+	header := make([]byte, _diskHeaderSize)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidEntry)
+		}
+
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	if !strings.HasPrefix(string(header), _diskMagic) || header[len(_diskMagic)] != _diskVersion {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidEntry)
+	}
+
+	length := binary.BigEndian.Uint32(header[len(_diskMagic)+1:])
+	if length > _diskMaxMetadataSize {
+		return nil, fmt.Errorf("%w: metadata is too large", ErrInvalidEntry)
+	}
+
+	encoded := make([]byte, length)
+
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, fmt.Errorf("%w: truncated metadata", ErrInvalidEntry)
+	}
+
+	var metadata *diskMetadata
+
+	if err := json.Unmarshal(encoded, &metadata); err != nil || metadata == nil {
+		return nil, fmt.Errorf("%w: invalid metadata", ErrInvalidEntry)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,594 @@
+package cache_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/testutil"
+	"git.sr.ht/~jamesponddotco/privytar/internal/timeutil"
+)
+
+func TestDiskCache_Get(t *testing.T) {
+	t.Parallel()
+
+	cacheDuration := timeutil.CacheDuration{
+		Duration: 100 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name        string
+		preloadKeys map[string][]byte
+		getKey      string
+		want        []byte
+		wantErr     error
+	}{
+		{
+			name: "test get valid key",
+			preloadKeys: map[string][]byte{
+				"validKey": []byte("validValue"),
+			},
+			getKey: "validKey",
+			want:   []byte("validValue"),
+		},
+		{
+			name: "test get invalid key",
+			preloadKeys: map[string][]byte{
+				"validKey": []byte("validValue"),
+			},
+			getKey:  "invalidKey",
+			wantErr: cache.ErrKeyNotFound,
+		},
+		{
+			name: "test get expired key",
+			preloadKeys: map[string][]byte{
+				"expiredKey": []byte("expiredValue"),
+			},
+			getKey:  "expiredKey",
+			wantErr: cache.ErrKeyExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			clock := testutil.NewClock()
+
+			c, err := cache.NewDisk(t.TempDir(), &cache.Options{Expiration: cacheDuration, Now: clock.Now})
+			if err != nil {
+				t.Fatalf("Setup error: %v", err)
+			}
+
+			for key, value := range tt.preloadKeys {
+				if err = c.Set(key, &cache.Item{Value: value}); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			}
+
+			if _, ok := tt.preloadKeys["expiredKey"]; ok {
+				clock.Advance(cacheDuration.Duration + time.Millisecond)
+			}
+
+			got, err := c.Get(tt.getKey)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DiskCache.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !bytes.Equal(itemValue(got), tt.want) {
+				t.Errorf("DiskCache.Get() = %v, want %v", itemValue(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskCache_Get_Stale(t *testing.T) {
+	t.Parallel()
+
+	clock := testutil.NewClock()
+
+	c, err := cache.NewDisk(t.TempDir(), &cache.Options{
+		Expiration:           timeutil.CacheDuration{Duration: 50 * time.Millisecond},
+		StaleWhileRevalidate: timeutil.CacheDuration{Duration: 1 * time.Hour},
+		Now:                  clock.Now,
+	})
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Set("key", &cache.Item{Value: []byte("value")}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+
+	got, err := c.Get("key")
+	if !errors.Is(err, cache.ErrKeyStale) {
+		t.Errorf("DiskCache.Get() error = %v, wantErr %v", err, cache.ErrKeyStale)
+	}
+
+	if !bytes.Equal(itemValue(got), []byte("value")) {
+		t.Errorf("DiskCache.Get() = %v, want %v", itemValue(got), []byte("value"))
+	}
+}
+
+func TestDiskCache_Get_NotFound(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir  = t.TempDir()
+		opts = &cache.Options{
+			Expiration:         timeutil.CacheDuration{Duration: 1 * time.Hour},
+			NotFoundExpiration: timeutil.CacheDuration{Duration: 1 * time.Hour},
+		}
+	)
+
+	c, err := cache.NewDisk(dir, opts)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Set("key", &cache.Item{NotFound: true}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	// The entry is reloaded from disk, so it must keep recording that the
+	// image doesn't exist.
+	reloaded, err := cache.NewDisk(dir, opts)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	got, err := reloaded.Get("key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !got.NotFound {
+		t.Errorf("DiskCache.Get() NotFound = false, want true")
+	}
+}
+
+func TestDiskCache_Set(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		initialKeys []string
+		setKey      string
+		setValue    []byte
+		wantErr     error
+		evictedKey  string
+	}{
+		{
+			name:     "Add new entry",
+			maxBytes: 1024,
+			setKey:   "key",
+			setValue: []byte("value"),
+		},
+		{
+			name:        "Overwrite existing entry",
+			maxBytes:    1024,
+			initialKeys: []string{"key"},
+			setKey:      "key",
+			setValue:    []byte("newValue"),
+		},
+		{
+			name:        "Cache over maximum size",
+			maxBytes:    160,
+			initialKeys: []string{"key1", "key2"},
+			setKey:      "key3",
+			setValue:    []byte("val3"),
+			evictedKey:  "key1",
+		},
+		{
+			name:     "Entry larger than cache",
+			maxBytes: 8,
+			setKey:   "key",
+			setValue: []byte("value"),
+			wantErr:  cache.ErrEntryTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The clock keeps the size of entry headers, which include the
+			// time they were added, stable.
+			c, err := cache.NewDisk(t.TempDir(), &cache.Options{
+				Expiration: timeutil.CacheDuration{Duration: 5 * time.Minute},
+				MaxBytes:   tt.maxBytes,
+				Now:        testutil.NewClock().Now,
+			})
+			if err != nil {
+				t.Fatalf("Setup error: %v", err)
+			}
+
+			for _, key := range tt.initialKeys {
+				if err = c.Set(key, &cache.Item{Value: []byte("oldValue")}); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			}
+
+			if err = c.Set(tt.setKey, &cache.Item{Value: tt.setValue}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DiskCache.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			value, err := c.Get(tt.setKey)
+			if err != nil {
+				t.Errorf("Failed to retrieve set key: %v", err)
+			}
+
+			if !bytes.Equal(itemValue(value), tt.setValue) {
+				t.Errorf("DiskCache.Get() = %v, expected %v", itemValue(value), tt.setValue)
+			}
+
+			if tt.evictedKey != "" {
+				if _, err := c.Get(tt.evictedKey); !errors.Is(err, cache.ErrKeyNotFound) {
+					t.Errorf("Expected key %s to be evicted", tt.evictedKey)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskCache_SetOptions(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.NewDisk(t.TempDir(), &cache.Options{
+		Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour},
+		Capacity:   3,
+	})
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err = c.Set(key, &cache.Item{Value: []byte(key)}); err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+	}
+
+	err = c.SetOptions(&cache.Options{
+		Expiration: timeutil.CacheDuration{Duration: 1 * time.Minute},
+		Capacity:   2,
+	})
+	if err != nil {
+		t.Fatalf("DiskCache.SetOptions() error = %v", err)
+	}
+
+	// The least recently used entry is evicted to fit the new capacity.
+	if _, err = c.Get("key1"); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Errorf("DiskCache.Get() error = %v, wantErr %v", err, cache.ErrKeyNotFound)
+	}
+
+	got, err := c.Get("key3")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Entries already in the cache use the new expiration time.
+	if want := got.Modified.Add(1 * time.Minute); !got.Expires.Equal(want) {
+		t.Errorf("DiskCache.Get() expiration time = %v, want %v", got.Expires, want)
+	}
+}
+
+func TestDiskCache_Delete(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.NewDisk(t.TempDir(), &cache.Options{Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour}})
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Set("foo", &cache.Item{Value: []byte("bar")}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Delete("foo"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if _, err = c.Get("foo"); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Errorf("Expected key foo to be absent, got: %v", err)
+	}
+
+	if err = c.Delete("foo"); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Errorf("Expected error: %v, got: %v", cache.ErrKeyNotFound, err)
+	}
+}
+
+func TestDiskCache_Probe(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	c, err := cache.NewDisk(dir, &cache.Options{Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour}})
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Probe(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The probe cleans up after itself.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("Expected an empty cache directory, got %d files", len(entries))
+	}
+
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Probe(); err == nil {
+		t.Errorf("Expected an error probing a removed cache directory")
+	}
+}
+
+func TestDiskCache_Get_Unreadable(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	c, err := cache.NewDisk(dir, &cache.Options{Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour}})
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Set("foo", &cache.Item{Value: []byte("bar")}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Setup error: expected a single entry on disk, got %v (%v)", files, err)
+	}
+
+	if err = os.WriteFile(files[0], []byte("corrupted"), 0o600); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if _, err = c.Get("foo"); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Errorf("Expected error: %v, got: %v", cache.ErrKeyNotFound, err)
+	}
+
+	// The unreadable entry is dropped from the index.
+	if err = c.Delete("foo"); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Errorf("Expected error: %v, got: %v", cache.ErrKeyNotFound, err)
+	}
+}
+
+func TestDiskCache_Get_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.NewDisk(t.TempDir(), &cache.Options{Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour}})
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	if err = c.Set("foo", &cache.Item{Value: []byte("value-0")}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+
+	// Entries rewritten while they are read are never reported as missing,
+	// nor dropped from the cache.
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			if i%2 == 0 {
+				if err := c.Set("foo", &cache.Item{Value: []byte("value-" + strconv.Itoa(i))}); err != nil {
+					t.Errorf("Failed to set key foo: %v", err)
+				}
+
+				return
+			}
+
+			value, err := c.Get("foo")
+			if err != nil {
+				t.Errorf("Failed to retrieve key foo: %v", err)
+
+				return
+			}
+
+			if !bytes.HasPrefix(value.Value, []byte("value-")) {
+				t.Errorf("DiskCache.Get() = %q, expected one of the values set", value.Value)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if _, err = c.Get("foo"); err != nil {
+		t.Errorf("Failed to retrieve key foo: %v", err)
+	}
+}
+
+func TestDiskCache_Set_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir  = t.TempDir()
+		opts = &cache.Options{Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour}}
+		keys = []string{"foo", "bar", "baz"}
+	)
+
+	c, err := cache.NewDisk(dir, opts)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			key := keys[i%len(keys)]
+
+			if err := c.Set(key, &cache.Item{Value: []byte(key + "Value")}); err != nil {
+				t.Errorf("Failed to set key %q: %v", key, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	temps, err := filepath.Glob(filepath.Join(dir, "*", "*", ".tmp-*"))
+	if err != nil || len(temps) > 0 {
+		t.Errorf("Expected no temporary files to be left behind, got %v (%v)", temps, err)
+	}
+
+	// Every entry is indexed once and can be read back, even after reopening
+	// the cache.
+	reopened, err := cache.NewDisk(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen cache: %v", err)
+	}
+
+	for _, key := range keys {
+		for _, backend := range []cache.Backend{c, reopened} {
+			value, err := backend.Get(key)
+			if err != nil {
+				t.Fatalf("Failed to retrieve key %q: %v", key, err)
+			}
+
+			if !bytes.Equal(itemValue(value), []byte(key+"Value")) {
+				t.Errorf("DiskCache.Get() = %v, expected %v", itemValue(value), []byte(key+"Value"))
+			}
+		}
+	}
+}
+
+func TestDiskCache_Persistence(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir   = t.TempDir()
+		clock = testutil.NewClock()
+		opts  = &cache.Options{
+			Expiration: timeutil.CacheDuration{Duration: 1 * time.Hour},
+			Now:        clock.Now,
+		}
+		unrelated = filepath.Join(dir, "README")
+	)
+
+	if err := os.WriteFile(unrelated, []byte("not a cache entry"), 0o600); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	first, err := cache.NewDisk(dir, opts)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	item := &cache.Item{
+		ContentType: "image/png",
+		ETag:        `"etag"`,
+		Value:       []byte("value"),
+	}
+
+	if err = first.Set("key", item); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	// The clock is far from the file's modification time, so the time the
+	// entry was added can only come from its header.
+	added := clock.Now()
+
+	clock.Advance(10 * time.Minute)
+
+	second, err := cache.NewDisk(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen cache: %v", err)
+	}
+
+	value, err := second.Get("key")
+	if err != nil {
+		t.Fatalf("Failed to retrieve key after reopening: %v", err)
+	}
+
+	if !bytes.Equal(itemValue(value), []byte("value")) {
+		t.Errorf("DiskCache.Get() = %v, expected %v", itemValue(value), []byte("value"))
+	}
+
+	if value.ContentType != item.ContentType {
+		t.Errorf("DiskCache.Get() content type = %q, expected %q", value.ContentType, item.ContentType)
+	}
+
+	if value.ETag != item.ETag {
+		t.Errorf("DiskCache.Get() ETag = %q, expected %q", value.ETag, item.ETag)
+	}
+
+	if !value.Modified.Equal(added) {
+		t.Errorf("DiskCache.Get() modification time = %v, expected %v", value.Modified, added)
+	}
+
+	if want := added.Add(time.Hour); !value.Expires.Equal(want) {
+		t.Errorf("DiskCache.Get() expiration time = %v, expected %v", value.Expires, want)
+	}
+
+	if _, err = os.Stat(unrelated); err != nil {
+		t.Errorf("Expected unrelated file to be left untouched: %v", err)
+	}
+}
+
+func TestDiskCache_Load_TempFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "ab", "cd"), 0o700); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	paths := []string{
+		filepath.Join(dir, ".tmp-probe"),
+		filepath.Join(dir, "ab", ".tmp-entry"),
+		filepath.Join(dir, "ab", "cd", ".tmp-entry"),
+	}
+
+	for _, path := range paths {
+		if err := os.WriteFile(path, []byte("partial"), 0o600); err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+	}
+
+	if _, err := cache.NewDisk(dir, &cache.Options{}); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected temporary file %s to be removed, got %v", path, err)
+		}
+	}
+}
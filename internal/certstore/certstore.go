@@ -0,0 +1,169 @@
+// Package certstore provides a TLS certificate store that reloads its key pair
+// from disk, so renewed certificates are picked up without restarting the
+// service.
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+// ErrLoadCertificate is returned when the key pair can't be loaded.
+const ErrLoadCertificate xerrors.Error = "failed to load TLS certificate"
+
+// DefaultInterval is the default interval at which the key pair files are
+// checked for changes.
+const DefaultInterval time.Duration = time.Minute
+
+// Store holds the TLS certificate served by the service and swaps it
+// atomically when its files change.
+type Store struct {
+	// cert is the certificate currently served.
+	cert atomic.Pointer[tls.Certificate]
+
+	// logger is used to report reloads and failures while watching.
+	logger *slog.Logger
+
+	// certFile is the path to the certificate.
+	certFile string
+
+	// keyFile is the path to the private key.
+	keyFile string
+
+	// modified is the latest modification time of the key pair files when
+	// they were last loaded.
+	modified time.Time
+
+	// mu serializes reloads.
+	mu sync.Mutex
+}
+
+// New returns a store serving the key pair at the given paths. The key pair
+// must be valid when the store is created.
+func New(certFile, keyFile string, logger *slog.Logger) (*Store, error) {
+	s := &Store{
+		logger:   logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as
+// the GetCertificate callback of a tls.Config.
+func (s *Store) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// Reload loads the key pair from disk and starts serving it. If the key pair
+// is invalid, such as while only one of the files has been renewed, the
+// current certificate is kept and an error is returned.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	modified, err := s.lastModified()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLoadCertificate, err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLoadCertificate, err)
+	}
+
+	s.cert.Store(&cert)
+	s.modified = modified
+
+	return nil
+}
+
+// Watch checks the key pair files for changes at the given interval until the
+// context is canceled, reloading them when they change. Failures are logged
+// and retried at the next interval, keeping the current certificate.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+
+			if err := s.Reload(); err != nil {
+				s.logger.LogAttrs(
+					ctx,
+					slog.LevelError,
+					"failed to reload TLS certificate; keeping the current one",
+					slog.String("certificate", s.certFile),
+					slog.String("error", err.Error()),
+				)
+
+				continue
+			}
+
+			s.logger.LogAttrs(
+				ctx,
+				slog.LevelInfo,
+				"reloaded TLS certificate",
+				slog.String("certificate", s.certFile),
+			)
+		}
+	}
+}
+
+// changed reports whether the key pair files were modified since they were
+// last loaded.
+func (s *Store) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	modified, err := s.lastModified()
+	if err != nil {
+		// Missing files are reported when reloading them.
+		return true
+	}
+
+	return !modified.Equal(s.modified)
+}
+
+// lastModified returns the latest modification time of the key pair files,
+// following symbolic links such as the ones maintained by certbot. The caller
+// must hold the lock.
+func (s *Store) lastModified() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{s.certFile, s.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w", err)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,211 @@
+package certstore_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/certstore"
+)
+
+func TestStore_Reload(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		renew    func(t *testing.T, certFile, keyFile string)
+		wantName string
+		wantErr  error
+	}{
+		{
+			name: "Renewed key pair",
+			renew: func(t *testing.T, certFile, keyFile string) {
+				t.Helper()
+
+				writeKeyPair(t, certFile, keyFile, "renewed.example.com")
+			},
+			wantName: "renewed.example.com",
+		},
+		{
+			name: "Mismatched key pair",
+			renew: func(t *testing.T, certFile, _ string) {
+				t.Helper()
+
+				// Only the certificate is renewed, so it doesn't match the key.
+				writeKeyPair(t, certFile, filepath.Join(t.TempDir(), "other.key"), "renewed.example.com")
+			},
+			wantName: "initial.example.com",
+			wantErr:  certstore.ErrLoadCertificate,
+		},
+		{
+			name: "Missing key",
+			renew: func(t *testing.T, _, keyFile string) {
+				t.Helper()
+
+				if err := os.Remove(keyFile); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			},
+			wantName: "initial.example.com",
+			wantErr:  certstore.ErrLoadCertificate,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				dir      = t.TempDir()
+				certFile = filepath.Join(dir, "cert.pem")
+				keyFile  = filepath.Join(dir, "key.pem")
+			)
+
+			writeKeyPair(t, certFile, keyFile, "initial.example.com")
+
+			store, err := certstore.New(certFile, keyFile, testLogger())
+			if err != nil {
+				t.Fatalf("Setup error: %v", err)
+			}
+
+			tt.renew(t, certFile, keyFile)
+
+			if err = store.Reload(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := commonName(t, store); got != tt.wantName {
+				t.Errorf("GetCertificate() = %q, want %q", got, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestStore_Watch(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+	)
+
+	writeKeyPair(t, certFile, keyFile, "initial.example.com")
+
+	store, err := certstore.New(certFile, keyFile, testLogger())
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go store.Watch(ctx, 10*time.Millisecond)
+
+	writeKeyPair(t, certFile, keyFile, "renewed.example.com")
+
+	// Make sure the change is noticed on file systems with coarse timestamps.
+	future := time.Now().Add(time.Hour)
+	for _, path := range []string{certFile, keyFile} {
+		if err = os.Chtimes(path, future, future); err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for commonName(t, store) != "renewed.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("Watch() didn't reload the renewed certificate")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	_, err := certstore.New(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), testLogger())
+	if !errors.Is(err, certstore.ErrLoadCertificate) {
+		t.Errorf("New() error = %v, wantErr %v", err, certstore.ErrLoadCertificate)
+	}
+}
+
+// writeKeyPair writes a self-signed certificate for the given name and its key
+// to the given paths.
+func writeKeyPair(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+}
+
+// commonName returns the common name of the certificate currently served by
+// the store.
+func commonName(t *testing.T, store *certstore.Store) string {
+	t.Helper()
+
+	cert, err := store.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+// testLogger returns a logger discarding its output.
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
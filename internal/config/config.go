@@ -4,12 +4,15 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"git.sr.ht/~jamesponddotco/privytar/internal/meta"
 	"git.sr.ht/~jamesponddotco/privytar/internal/timeutil"
+	"git.sr.ht/~jamesponddotco/privytar/internal/upstream"
 	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
 )
 
@@ -35,14 +38,103 @@ const (
 	// ErrInvalidTLSVersion is returned when the TLS version is invalid.
 	ErrInvalidTLSVersion xerrors.Error = "server's TLS version is invalid; must be 1.2 or 1.3"
 
+	// ErrACMEListener is returned when ACME is enabled without the TLS
+	// listener.
+	ErrACMEListener xerrors.Error = "server's ACME configuration requires the tls listener"
+
+	// ErrMissingACMEDomains is returned when ACME is enabled without domains
+	// to obtain certificates for.
+	ErrMissingACMEDomains xerrors.Error = "server's ACME domains are missing"
+
+	// ErrMissingACMECacheDirectory is returned when ACME is enabled without a
+	// directory to store certificates in.
+	ErrMissingACMECacheDirectory xerrors.Error = "server's ACME cache directory is missing"
+
+	// ErrInvalidACMEDirectory is returned when the ACME directory URL is
+	// invalid.
+	ErrInvalidACMEDirectory xerrors.Error = "server's ACME directory is invalid; must be an absolute HTTPS URL"
+
 	// ErrInvalidHomepage is returned when the homepage is invalid.
 	ErrInvalidHomepage xerrors.Error = "service's homepage is invalid"
 
+	// ErrInvalidBaseURL is returned when the base URL is invalid.
+	ErrInvalidBaseURL xerrors.Error = "service's base URL is invalid; must be an absolute HTTP or HTTPS URL"
+
 	// ErrInvalidPrivacyPolicy is returned when the privacy policy is invalid.
 	ErrInvalidPrivacyPolicy xerrors.Error = "service's privacy policy is invalid"
 
 	// ErrInvalidTermsOfService is returned when the terms of service is invalid.
 	ErrInvalidTermsOfService xerrors.Error = "service's terms of service is invalid"
+
+	// ErrInvalidListener is returned when the listener is invalid.
+	ErrInvalidListener xerrors.Error = "server's listener is invalid; must be tls, http, or unix"
+
+	// ErrMissingSocket is returned when the Unix socket listener is selected
+	// but the socket path is missing.
+	ErrMissingSocket xerrors.Error = "server's socket path is missing"
+
+	// ErrInvalidSocketMode is returned when the socket's file mode is
+	// invalid.
+	ErrInvalidSocketMode xerrors.Error = "server's socket mode is invalid; must be an octal file mode such as 0660"
+
+	// ErrInvalidLogLevel is returned when the log level is invalid.
+	ErrInvalidLogLevel xerrors.Error = "server's log level is invalid; must be debug, info, warn, or error"
+
+	// ErrInvalidCacheBackend is returned when the cache backend is invalid.
+	ErrInvalidCacheBackend xerrors.Error = "server's cache backend is invalid; must be memory or disk"
+
+	// ErrMissingCacheDirectory is returned when the disk cache backend is
+	// selected but the cache directory is missing.
+	ErrMissingCacheDirectory xerrors.Error = "server's cache directory is missing"
+
+	// ErrInvalidCacheMaxBytes is returned when one of the cache size limits is
+	// negative.
+	ErrInvalidCacheMaxBytes xerrors.Error = "server's cache size limits are invalid; must not be negative"
+
+	// ErrMissingUpstreamName is returned when an upstream has no name.
+	ErrMissingUpstreamName xerrors.Error = "upstream's name is missing"
+
+	// ErrInvalidUpstream is returned when an upstream's URL template is
+	// invalid.
+	ErrInvalidUpstream xerrors.Error = "upstream's URL is invalid"
+
+	// ErrInvalidQuality is returned when the optimization quality is invalid.
+	ErrInvalidQuality xerrors.Error = "optimization quality is invalid; must be between 1 and 100"
+
+	// ErrInvalidCompression is returned when the optimization compression
+	// level is invalid.
+	ErrInvalidCompression xerrors.Error = "optimization compression level is invalid; must be between 1 and 9"
+
+	// ErrInvalidMasterSize is returned when the master image size is invalid.
+	ErrInvalidMasterSize xerrors.Error = "server's master image size is invalid; must be between 1 and 2048"
+
+	// ErrInvalidUpstreamRateLimit is returned when the rate of requests sent
+	// to upstreams is invalid.
+	ErrInvalidUpstreamRateLimit xerrors.Error = "upstream rate limit is invalid; must be greater than 0"
+
+	// ErrInvalidUpstreamRateBurst is returned when the number of requests
+	// sent to upstreams at once is invalid.
+	ErrInvalidUpstreamRateBurst xerrors.Error = "upstream rate burst is invalid; must be greater than 0"
+)
+
+const (
+	// ListenerTLS is the name of the listener serving HTTPS over TCP.
+	ListenerTLS string = "tls"
+
+	// ListenerHTTP is the name of the listener serving plain HTTP over TCP.
+	ListenerHTTP string = "http"
+
+	// ListenerUnix is the name of the listener serving plain HTTP over a Unix
+	// domain socket.
+	ListenerUnix string = "unix"
+)
+
+const (
+	// CacheBackendMemory is the name of the in-memory cache backend.
+	CacheBackendMemory string = "memory"
+
+	// CacheBackendDisk is the name of the on-disk cache backend.
+	CacheBackendDisk string = "disk"
 )
 
 const (
@@ -59,6 +151,64 @@ const (
 	// DefaultCacheCapacity is the default capacity of the cache.
 	DefaultCacheCapacity uint = 8192
 
+	// DefaultCacheMaxBytes is the default maximum size of the in-memory cache.
+	DefaultCacheMaxBytes int64 = 256 << 20
+
+	// DefaultCacheMaxEntryBytes is the default maximum size of a single cache
+	// entry.
+	DefaultCacheMaxEntryBytes int64 = 2 << 20
+
+	// DefaultACMEDirectory is the default ACME directory, Let's Encrypt's
+	// production environment.
+	DefaultACMEDirectory string = "https://acme-v02.api.letsencrypt.org/directory"
+
+	// DefaultListener is the default listener.
+	DefaultListener string = ListenerTLS
+
+	// DefaultSocketMode is the default file mode of the Unix socket, letting
+	// the socket's group connect to it.
+	DefaultSocketMode string = "0660"
+
+	// DefaultLogLevel is the default minimum level of the messages logged.
+	DefaultLogLevel string = "info"
+
+	// DefaultCacheBackend is the default cache backend.
+	DefaultCacheBackend string = CacheBackendMemory
+
+	// DefaultCacheDiskMaxBytes is the default maximum size of the disk cache.
+	DefaultCacheDiskMaxBytes int64 = 1 << 30
+
+	// DefaultCustomDefaultMaxBytes is the default maximum size of a custom
+	// default image.
+	DefaultCustomDefaultMaxBytes int64 = 1 << 20
+
+	// DefaultLibravatarMaxBytes is the default maximum size of an avatar
+	// fetched from a federated Libravatar server.
+	DefaultLibravatarMaxBytes int64 = 1 << 20
+
+	// DefaultMasterSize is the default size of the master image avatars are
+	// resized from.
+	DefaultMasterSize int = 512
+
+	// MaxMasterSize is the largest master image size, which is the largest
+	// size Gravatar serves.
+	MaxMasterSize int = 2048
+
+	// DefaultUpstreamRateLimit is the default maximum number of requests per
+	// second sent to upstreams.
+	DefaultUpstreamRateLimit float64 = 2
+
+	// DefaultUpstreamRateBurst is the default number of requests sent to
+	// upstreams at once.
+	DefaultUpstreamRateBurst int = 1
+
+	// DefaultQuality is the default quality of optimized images.
+	DefaultQuality uint = 60
+
+	// DefaultCompression is the default compression level of optimized PNG
+	// images.
+	DefaultCompression uint = 9
+
 	// DefaultServiceName is the default name of the service.
 	DefaultServiceName string = meta.Name
 
@@ -76,6 +226,50 @@ type TLS struct {
 
 	// Version is the TLS version to use.
 	Version string `json:"version"`
+
+	// ReloadInterval is how often the certificate and key are checked for
+	// changes, so renewed certificates are served without a restart.
+	ReloadInterval timeutil.CacheDuration `json:"reloadInterval"`
+}
+
+// ACME represents the configuration of automatic certificate management
+// through an ACME certificate authority such as Let's Encrypt.
+type ACME struct {
+	// Email is the contact address registered with the certificate
+	// authority, used to warn about problems with certificates.
+	Email string `json:"email"`
+
+	// Domains are the domains certificates are obtained for. Requests for
+	// other domains are refused.
+	Domains []string `json:"domains"`
+
+	// Directory is the URL of the certificate authority's ACME directory.
+	Directory string `json:"directory"`
+
+	// RootCA is the path to a PEM file with the certificate authority used to
+	// verify the ACME directory, for test authorities such as Pebble. The
+	// system's roots are used if empty.
+	RootCA string `json:"rootCA"`
+
+	// CacheDirectory is the directory where certificates and the account key
+	// are stored.
+	CacheDirectory string `json:"cacheDirectory"`
+
+	// HTTPAddress is the address answering HTTP-01 challenges and redirecting
+	// other requests to HTTPS. Only TLS-ALPN-01 challenges are answered if
+	// empty.
+	HTTPAddress string `json:"httpAddress"`
+}
+
+// Upstream represents an avatar provider the service fetches avatars from.
+type Upstream struct {
+	// Name identifies the upstream in logs.
+	Name string `json:"name"`
+
+	// URL is the URL template of the upstream's avatars, where {hash} is
+	// replaced by the hash of the email address and {query} by the query
+	// string.
+	URL string `json:"url"`
 }
 
 // Server represents the server configuration.
@@ -83,20 +277,151 @@ type Server struct {
 	// TLS is the TLS configuration.
 	TLS *TLS `json:"tls"`
 
-	// Address is the address of the application.
+	// ACME is the automatic certificate management configuration. When set,
+	// certificates are obtained and renewed automatically instead of being
+	// loaded from the TLS configuration.
+	ACME *ACME `json:"acme"`
+
+	// Listener is how the application accepts connections: tls for HTTPS
+	// over TCP, http for plain HTTP over TCP, or unix for plain HTTP over a
+	// Unix domain socket. Plain HTTP is meant for running behind a reverse
+	// proxy.
+	Listener string `json:"listener"`
+
+	// Address is the address of the application, used by the tls and http
+	// listeners.
 	Address string `json:"address"`
 
+	// Socket is the path to the Unix domain socket used by the unix
+	// listener.
+	Socket string `json:"socket"`
+
+	// SocketMode is the file mode of the Unix domain socket, in octal.
+	SocketMode string `json:"socketMode"`
+
+	// SocketOwner is the owner of the Unix domain socket, either user or
+	// user:group, given as names or numeric IDs. Empty keeps the owner of the
+	// process.
+	SocketOwner string `json:"socketOwner"`
+
 	// PID is the path to the PID file.
 	PID string `json:"pid"`
 
-	// CacheCapacity is the capacity of the cache.
+	// CacheCapacity is the maximum number of entries in the in-memory cache.
 	CacheCapacity uint `json:"cacheCapacity"`
 
+	// CacheMaxBytes is the maximum size in bytes of the in-memory cache.
+	CacheMaxBytes int64 `json:"cacheMaxBytes"`
+
+	// CacheMaxEntryBytes is the maximum size in bytes of a single cache entry.
+	// Larger images are served but not cached.
+	CacheMaxEntryBytes int64 `json:"cacheMaxEntryBytes"`
+
 	// CacheTTL is the TTL of the cache.
 	CacheTTL timeutil.CacheDuration `json:"cacheTTL"`
 
+	// CacheStaleWhileRevalidate is how long after expiring a cached image is
+	// still served while it is refreshed in the background. Zero disables it.
+	CacheStaleWhileRevalidate timeutil.CacheDuration `json:"cacheStaleWhileRevalidate"`
+
+	// CacheStaleIfError is how long after expiring a cached image is still
+	// served when refreshing it fails. Zero disables it.
+	CacheStaleIfError timeutil.CacheDuration `json:"cacheStaleIfError"`
+
+	// CacheNotFoundTTL is how long the service remembers that a hash has no
+	// avatar upstream, answering with a 404 without asking again.
+	CacheNotFoundTTL timeutil.CacheDuration `json:"cacheNotFoundTTL"`
+
+	// CacheBackend is the storage backend of the cache, either memory or
+	// disk.
+	CacheBackend string `json:"cacheBackend"`
+
+	// CacheDirectory is the path to the directory used by the disk cache
+	// backend.
+	CacheDirectory string `json:"cacheDirectory"`
+
+	// CacheDiskMaxBytes is the maximum size in bytes of the disk cache
+	// backend.
+	CacheDiskMaxBytes int64 `json:"cacheDiskMaxBytes"`
+
+	// CacheSharedMaxAge is the s-maxage sent to shared caches, such as CDNs
+	// and reverse proxies. Zero omits it.
+	CacheSharedMaxAge timeutil.CacheDuration `json:"cacheSharedMaxAge"`
+
+	// CacheImmutable defines whether avatars are marked as immutable, telling
+	// browsers not to revalidate them while they are fresh.
+	CacheImmutable bool `json:"cacheImmutable"`
+
+	// Upstreams is the list of avatar providers, tried in order until one of
+	// them has the avatar. Defaults to Gravatar alone.
+	Upstreams []*Upstream `json:"upstreams"`
+
+	// MasterSize is the size in pixels of the master image fetched from
+	// Gravatar for each hash. Smaller sizes are resized from it locally, while
+	// larger ones are fetched as they are.
+	MasterSize int `json:"masterSize"`
+
+	// UpstreamRateLimit is the maximum number of requests per second sent to
+	// upstreams, shared between all of them.
+	UpstreamRateLimit float64 `json:"upstreamRateLimit"`
+
+	// UpstreamRateBurst is the number of requests that may be sent to
+	// upstreams at once before UpstreamRateLimit applies.
+	UpstreamRateBurst int `json:"upstreamRateBurst"`
+
+	// CustomDefaultHosts is the list of hosts custom default images, given as
+	// a URL in the d parameter, may be fetched from. A host starting with a
+	// dot also matches its subdomains. Empty disables custom default images.
+	CustomDefaultHosts []string `json:"customDefaultHosts"`
+
+	// CustomDefaultMaxBytes is the maximum size in bytes of a custom default
+	// image.
+	CustomDefaultMaxBytes int64 `json:"customDefaultMaxBytes"`
+
+	// LibravatarFederation defines whether avatars may be fetched from the
+	// federated Libravatar server of the domain given in the domain
+	// parameter, found through DNS SRV records.
+	LibravatarFederation bool `json:"libravatarFederation"`
+
+	// LibravatarMaxBytes is the maximum size in bytes of an avatar fetched
+	// from a federated Libravatar server.
+	LibravatarMaxBytes int64 `json:"libravatarMaxBytes"`
+
+	// ReadyUpstreamProbe defines whether the readiness endpoint checks that
+	// at least one upstream answers.
+	ReadyUpstreamProbe bool `json:"readyUpstreamProbe"`
+
+	// ReadyUpstreamProbeTTL is how long the result of the upstream probe is
+	// reused before probing the upstreams again.
+	ReadyUpstreamProbeTTL timeutil.CacheDuration `json:"readyUpstreamProbeTTL"`
+
 	// LogRequests defines whether the application should log requests.
 	LogRequests bool `json:"logRequests"`
+
+	// LogLevel is the minimum level of the messages logged: debug, info,
+	// warn, or error.
+	LogLevel string `json:"logLevel"`
+}
+
+// Level returns the minimum level of the messages logged.
+func (s *Server) Level() (slog.Level, error) {
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidLogLevel, s.LogLevel)
+	}
+
+	return level, nil
+}
+
+// SocketFileMode returns the file mode of the Unix domain socket.
+func (s *Server) SocketFileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.SocketMode, 8, 32)
+	if err != nil || mode > uint64(os.ModePerm) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidSocketMode, s.SocketMode)
+	}
+
+	return os.FileMode(mode), nil
 }
 
 // Service represents the service configuration.
@@ -107,6 +432,11 @@ type Service struct {
 	// Homepage is the link to the service's homepage.
 	Homepage string `json:"homepage"`
 
+	// BaseURL is the public URL the service is reachable at, such as
+	// https://s.privytar.com. Avatars are sent with a canonical link
+	// pointing to it, which is omitted when it is empty.
+	BaseURL string `json:"baseURL"`
+
 	// Contact is the contact email for the service.
 	Contact string `json:"contact"`
 
@@ -117,6 +447,25 @@ type Service struct {
 	TermsOfService string `json:"termsOfService"`
 }
 
+// Optimization represents the image optimization configuration.
+type Optimization struct {
+	// Disabled defines whether optimization is skipped, serving images as
+	// they are fetched. Resized images are still encoded with the settings
+	// below.
+	Disabled bool `json:"disabled"`
+
+	// Quality is the quality of optimized images, between 1 and 100.
+	Quality uint `json:"quality"`
+
+	// Compression is the compression level of optimized PNG images, between
+	// 1 and 9.
+	Compression uint `json:"compression"`
+
+	// KeepMetadata defines whether metadata, such as EXIF data, is kept in
+	// optimized images.
+	KeepMetadata bool `json:"keepMetadata"`
+}
+
 // Config represents the application configuration.
 type Config struct {
 	// Service is the service configuration.
@@ -124,6 +473,18 @@ type Config struct {
 
 	// Server is the server configuration.
 	Server *Server `json:"server"`
+
+	// Optimization is the image optimization configuration.
+	Optimization *Optimization `json:"optimization"`
+
+	// path is the location of the file the configuration was loaded from.
+	path string
+}
+
+// Path returns the location of the file the configuration was loaded from, so
+// it can be loaded again.
+func (cfg *Config) Path() string {
+	return cfg.path
 }
 
 // LoadConfig opens a file and reads the configuration from it.
@@ -139,6 +500,8 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("%w: %w", ErrInvalidConfigFile, err)
 	}
 
+	cfg.path = path
+
 	if cfg.Server == nil {
 		cfg.Server = &Server{}
 	}
@@ -151,10 +514,30 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.Server.TLS.Version = DefaultMinTLSVersion
 	}
 
+	if cfg.Server.TLS.ReloadInterval.Duration == 0 {
+		defaultReloadInterval := timeutil.CacheDuration{
+			Duration: time.Minute,
+		}
+
+		cfg.Server.TLS.ReloadInterval = defaultReloadInterval
+	}
+
+	if cfg.Server.ACME != nil && cfg.Server.ACME.Directory == "" {
+		cfg.Server.ACME.Directory = DefaultACMEDirectory
+	}
+
+	if cfg.Server.Listener == "" {
+		cfg.Server.Listener = DefaultListener
+	}
+
 	if cfg.Server.Address == "" {
 		cfg.Server.Address = DefaultAddress
 	}
 
+	if cfg.Server.SocketMode == "" {
+		cfg.Server.SocketMode = DefaultSocketMode
+	}
+
 	if cfg.Server.PID == "" {
 		cfg.Server.PID = DefaultPID
 	}
@@ -163,6 +546,14 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.Server.CacheCapacity = DefaultCacheCapacity
 	}
 
+	if cfg.Server.CacheMaxBytes == 0 {
+		cfg.Server.CacheMaxBytes = DefaultCacheMaxBytes
+	}
+
+	if cfg.Server.CacheMaxEntryBytes == 0 {
+		cfg.Server.CacheMaxEntryBytes = DefaultCacheMaxEntryBytes
+	}
+
 	if cfg.Server.CacheTTL.Duration == 0 {
 		defaultCacheTTL := timeutil.CacheDuration{
 			Duration: 60 * time.Minute,
@@ -171,6 +562,63 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.Server.CacheTTL = defaultCacheTTL
 	}
 
+	if cfg.Server.CacheNotFoundTTL.Duration == 0 {
+		defaultCacheNotFoundTTL := timeutil.CacheDuration{
+			Duration: 10 * time.Minute,
+		}
+
+		cfg.Server.CacheNotFoundTTL = defaultCacheNotFoundTTL
+	}
+
+	if cfg.Server.ReadyUpstreamProbeTTL.Duration == 0 {
+		defaultReadyUpstreamProbeTTL := timeutil.CacheDuration{
+			Duration: time.Minute,
+		}
+
+		cfg.Server.ReadyUpstreamProbeTTL = defaultReadyUpstreamProbeTTL
+	}
+
+	if cfg.Server.LogLevel == "" {
+		cfg.Server.LogLevel = DefaultLogLevel
+	}
+
+	if cfg.Server.CacheBackend == "" {
+		cfg.Server.CacheBackend = DefaultCacheBackend
+	}
+
+	if cfg.Server.CacheDiskMaxBytes == 0 {
+		cfg.Server.CacheDiskMaxBytes = DefaultCacheDiskMaxBytes
+	}
+
+	if len(cfg.Server.Upstreams) == 0 {
+		cfg.Server.Upstreams = []*Upstream{
+			{
+				Name: upstream.GravatarName,
+				URL:  upstream.GravatarTemplate,
+			},
+		}
+	}
+
+	if cfg.Server.MasterSize == 0 {
+		cfg.Server.MasterSize = DefaultMasterSize
+	}
+
+	if cfg.Server.UpstreamRateLimit == 0 {
+		cfg.Server.UpstreamRateLimit = DefaultUpstreamRateLimit
+	}
+
+	if cfg.Server.UpstreamRateBurst == 0 {
+		cfg.Server.UpstreamRateBurst = DefaultUpstreamRateBurst
+	}
+
+	if cfg.Server.CustomDefaultMaxBytes == 0 {
+		cfg.Server.CustomDefaultMaxBytes = DefaultCustomDefaultMaxBytes
+	}
+
+	if cfg.Server.LibravatarMaxBytes == 0 {
+		cfg.Server.LibravatarMaxBytes = DefaultLibravatarMaxBytes
+	}
+
 	if cfg.Service == nil {
 		cfg.Service = &Service{}
 	}
@@ -183,6 +631,18 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.Service.Homepage = DefaultHomepage
 	}
 
+	if cfg.Optimization == nil {
+		cfg.Optimization = &Optimization{}
+	}
+
+	if cfg.Optimization.Quality == 0 {
+		cfg.Optimization.Quality = DefaultQuality
+	}
+
+	if cfg.Optimization.Compression == 0 {
+		cfg.Optimization.Compression = DefaultCompression
+	}
+
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrInvalidConfigFile, err)
 	}
@@ -204,22 +664,103 @@ func (cfg *Config) Validate() error {
 		return fmt.Errorf("%w", ErrMissingTermsOfService)
 	}
 
-	if cfg.Server.TLS.Certificate == "" {
-		return fmt.Errorf("%w", ErrMissingTLSCertificate)
+	if cfg.Server.ACME != nil && cfg.Server.Listener != ListenerTLS {
+		return fmt.Errorf("%w", ErrACMEListener)
+	}
+
+	switch cfg.Server.Listener {
+	case ListenerTLS:
+		if cfg.Server.ACME != nil {
+			if err := cfg.Server.ACME.validate(); err != nil {
+				return fmt.Errorf("%w", err)
+			}
+		} else {
+			if cfg.Server.TLS.Certificate == "" {
+				return fmt.Errorf("%w", ErrMissingTLSCertificate)
+			}
+
+			if cfg.Server.TLS.Key == "" {
+				return fmt.Errorf("%w", ErrMissingTLSKey)
+			}
+		}
+
+		if cfg.Server.TLS.Version != "1.3" && cfg.Server.TLS.Version != "1.2" {
+			return fmt.Errorf("%w", ErrInvalidTLSVersion)
+		}
+	case ListenerHTTP:
+	case ListenerUnix:
+		if cfg.Server.Socket == "" {
+			return fmt.Errorf("%w", ErrMissingSocket)
+		}
+
+		if _, err := cfg.Server.SocketFileMode(); err != nil {
+			return fmt.Errorf("%w", err)
+		}
+	default:
+		return fmt.Errorf("%w", ErrInvalidListener)
+	}
+
+	if _, err := cfg.Server.Level(); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if cfg.Server.CacheBackend != CacheBackendMemory && cfg.Server.CacheBackend != CacheBackendDisk {
+		return fmt.Errorf("%w", ErrInvalidCacheBackend)
+	}
+
+	if cfg.Server.CacheBackend == CacheBackendDisk && cfg.Server.CacheDirectory == "" {
+		return fmt.Errorf("%w", ErrMissingCacheDirectory)
+	}
+
+	if cfg.Server.CacheMaxBytes < 0 || cfg.Server.CacheMaxEntryBytes < 0 || cfg.Server.CacheDiskMaxBytes < 0 {
+		return fmt.Errorf("%w", ErrInvalidCacheMaxBytes)
+	}
+
+	for _, u := range cfg.Server.Upstreams {
+		if u.Name == "" {
+			return fmt.Errorf("%w", ErrMissingUpstreamName)
+		}
+
+		if _, err := upstream.New(u.Name, u.URL); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidUpstream, u.Name, err)
+		}
 	}
 
-	if cfg.Server.TLS.Key == "" {
-		return fmt.Errorf("%w", ErrMissingTLSKey)
+	if cfg.Server.MasterSize < 1 || cfg.Server.MasterSize > MaxMasterSize {
+		return fmt.Errorf("%w", ErrInvalidMasterSize)
 	}
 
-	if cfg.Server.TLS.Version != "1.3" && cfg.Server.TLS.Version != "1.2" {
-		return fmt.Errorf("%w", ErrInvalidTLSVersion)
+	if cfg.Server.UpstreamRateLimit <= 0 {
+		return fmt.Errorf("%w", ErrInvalidUpstreamRateLimit)
+	}
+
+	if cfg.Server.UpstreamRateBurst < 1 {
+		return fmt.Errorf("%w", ErrInvalidUpstreamRateBurst)
+	}
+
+	if cfg.Optimization.Quality < 1 || cfg.Optimization.Quality > 100 {
+		return fmt.Errorf("%w", ErrInvalidQuality)
+	}
+
+	if cfg.Optimization.Compression < 1 || cfg.Optimization.Compression > 9 {
+		return fmt.Errorf("%w", ErrInvalidCompression)
 	}
 
 	if _, err := url.Parse(cfg.Service.Homepage); err != nil {
 		return fmt.Errorf("%w: %w", ErrInvalidHomepage, err)
 	}
 
+	if cfg.Service.BaseURL != "" {
+		baseURL, err := url.Parse(cfg.Service.BaseURL)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidBaseURL, err)
+		}
+
+		if (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+			return fmt.Errorf("%w", ErrInvalidBaseURL)
+		}
+	}
+
 	if _, err := url.Parse(cfg.Service.PrivacyPolicy); err != nil {
 		return fmt.Errorf("%w: %w", ErrInvalidPrivacyPolicy, err)
 	}
@@ -230,3 +771,25 @@ func (cfg *Config) Validate() error {
 
 	return nil
 }
+
+// validate checks that the ACME configuration is valid.
+func (a *ACME) validate() error {
+	if len(a.Domains) == 0 {
+		return fmt.Errorf("%w", ErrMissingACMEDomains)
+	}
+
+	if a.CacheDirectory == "" {
+		return fmt.Errorf("%w", ErrMissingACMECacheDirectory)
+	}
+
+	directory, err := url.Parse(a.Directory)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidACMEDirectory, err)
+	}
+
+	if directory.Scheme != "https" || directory.Host == "" {
+		return fmt.Errorf("%w", ErrInvalidACMEDirectory)
+	}
+
+	return nil
+}
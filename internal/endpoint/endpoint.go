@@ -7,4 +7,11 @@ const (
 
 	// Avatar is the endpoint for the Avatar handler.
 	Avatar string = "/avatar/"
+
+	// Health is the endpoint reporting whether the process is alive.
+	Health string = "/healthz"
+
+	// Ready is the endpoint reporting whether the service is ready to serve
+	// avatars.
+	Ready string = "/readyz"
 )
@@ -3,74 +3,327 @@ package fetch
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"git.sr.ht/~jamesponddotco/httpx-go"
-	"git.sr.ht/~jamesponddotco/imgdiet-go"
+	"git.sr.ht/~jamesponddotco/privytar/internal/mediatype"
 	"git.sr.ht/~jamesponddotco/privytar/internal/meta"
 	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
 	"golang.org/x/time/rate"
 )
 
-// ErrFetchData is returned when the client fails to fetch data from a URL.
-const ErrFetchData xerrors.Error = "failed to fetch data"
+const (
+	// ErrFetchData is returned when the client fails to fetch data from a URL.
+	ErrFetchData xerrors.Error = "failed to fetch data"
+
+	// ErrNotFound is returned when the server reports that the requested image
+	// doesn't exist. It isn't a failure to fetch data, so it is returned
+	// without ErrFetchData.
+	ErrNotFound xerrors.Error = "image not found"
+
+	// ErrResizeImage is returned when an image can't be resized.
+	ErrResizeImage xerrors.Error = "failed to resize image"
+
+	// ErrRateLimited is returned along with ErrFetchData when the server asks
+	// the client to slow down, or when the client's own rate limit keeps a
+	// request from being sent in time.
+	ErrRateLimited xerrors.Error = "rate limited by server"
+
+	// ErrTimeout is returned along with ErrFetchData when the server takes
+	// too long to respond.
+	ErrTimeout xerrors.Error = "server timed out"
+
+	// ErrCanceled is returned along with ErrFetchData when the request is
+	// canceled before the server responds.
+	ErrCanceled xerrors.Error = "request canceled"
+
+	// ErrDecodeImage is returned along with ErrFetchData when the data
+	// returned by the server can't be decoded as an image.
+	ErrDecodeImage xerrors.Error = "failed to decode image"
+)
+
+const (
+	// MaxAttempts is the maximum number of times a request is sent when the
+	// server responds with a retryable status code such as 503.
+	MaxAttempts int = 3
+
+	// MaxRetryDelay is the longest the client waits before retrying a
+	// request, even if the server asks for longer, so retries fit within the
+	// time the service spends fetching an image.
+	MaxRetryDelay time.Duration = 2 * time.Second
+)
+
+// RateLimitError is returned along with ErrFetchData when the server responds
+// with a 429 Too Many Requests, or when the client's rate limit doesn't let a
+// request be sent before its deadline. It wraps ErrRateLimited.
+type RateLimitError struct {
+	// RetryAfter is how long the server or the rate limit asked the client to
+	// wait before trying again. Zero if the server didn't say.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter == 0 {
+		return ErrRateLimited.Error()
+	}
+
+	return ErrRateLimited.Error() + "; retry after " + e.RetryAfter.String()
+}
+
+// Unwrap returns ErrRateLimited.
+func (*RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// Image represents an image fetched from a URL.
+type Image struct {
+	// ContentType is the media type of the image, such as image/png.
+	ContentType string
+
+	// Data is the content of the image.
+	Data []byte
+
+	// Optimization reports how the image was optimized after being fetched.
+	// Nil for images that weren't fetched.
+	Optimization *Optimization
+}
 
 // Client represents a client that can fetch data from a URL.
 type Client struct {
 	// httpc is the underlying HTTP client used to fetch data.
 	httpc *httpx.Client
+
+	// untrusted is the HTTP client used to fetch URLs provided by users.
+	untrusted *httpx.Client
+
+	// probe is the HTTP client used by Probe, which neither waits for the
+	// rate limit nor retries requests.
+	probe *httpx.Client
+
+	// limiter limits the rate of requests sent by Remote, including retries.
+	limiter *rate.Limiter
+
+	// options defines how images are optimized.
+	options *Options
 }
 
-// New creates a new client that can fetch data from a URL.
-func New(serviceName, serviceEmail string) *Client {
+// New creates a new client that can fetch data from a URL, optimizing images
+// with the given options, or DefaultOptions if they are nil.
+func New(serviceName, serviceEmail string, opts *Options) *Client {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	userAgent := &httpx.UserAgent{
+		Token:   serviceName,
+		Version: meta.Version,
+		Comment: []string{serviceEmail},
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(2), 1)
+
 	return &Client{
 		httpc: &httpx.Client{
-			RateLimiter: rate.NewLimiter(rate.Limit(2), 1),
-			RetryPolicy: httpx.DefaultRetryPolicy(),
-			UserAgent: &httpx.UserAgent{
-				Token:   serviceName,
-				Version: meta.Version,
-				Comment: []string{serviceEmail},
-			},
-			Cache: nil,
+			RateLimiter: limiter,
+			RetryPolicy: newRetryPolicy(MaxAttempts, MaxRetryDelay),
+			UserAgent:   userAgent,
+			Cache:       nil,
 		},
+		untrusted: newUntrustedHTTPClient(userAgent),
+		probe:     &httpx.Client{UserAgent: userAgent},
+		limiter:   limiter,
+		options:   opts,
 	}
 }
 
-// Remote fetches data from a URL, optimizes it to reduce its size, and returns
-// it as a byte slice.
-func (c *Client) Remote(ctx context.Context, uri string) ([]byte, error) {
+// SetRateLimit changes the maximum number of requests per second sent by
+// Remote and the number of requests it may send at once. It is safe to call
+// while requests are being sent.
+func (c *Client) SetRateLimit(limit float64, burst int) {
+	c.limiter.SetLimit(rate.Limit(limit))
+	c.limiter.SetBurst(burst)
+}
+
+// SetRetryPolicy changes the maximum number of times a request is sent and
+// the longest the client waits between attempts, such as to keep tests from
+// waiting for retries. It must be called before the client sends requests.
+func (c *Client) SetRetryPolicy(attempts int, maxDelay time.Duration) {
+	c.httpc.RetryPolicy = newRetryPolicy(attempts, maxDelay)
+	c.untrusted.RetryPolicy = newRetryPolicy(attempts, maxDelay)
+}
+
+// newRetryPolicy returns the policy used to retry requests, which gives up
+// after the given number of attempts and waits at most maxDelay between them.
+func newRetryPolicy(attempts int, maxDelay time.Duration) *httpx.RetryPolicy {
+	policy := httpx.DefaultRetryPolicy()
+	policy.MaxRetries = attempts
+	policy.MinRetryDelay = min(policy.MinRetryDelay, maxDelay)
+	policy.MaxRetryDelay = maxDelay
+
+	return policy
+}
+
+// Remote fetches an image from a URL, optimizes it to reduce its size, and
+// returns the smaller of the original and optimized versions along with its
+// media type. Images larger than MaxImageBytes are refused.
+//
+// Requests over the rate limit wait for their turn until ctx is done. httpx
+// only applies its rate limiter to retries, so the first attempt waits here.
+func (c *Client) Remote(ctx context.Context, uri string) (*Image, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+
 	resp, err := c.httpc.Get(ctx, uri)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFetchData, err)
+		return nil, requestError(err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: %s", ErrFetchData, resp.Status)
+	if err = statusError(resp, uri); err != nil {
+		return nil, err
 	}
 
-	data, err := imgdiet.Open(resp.Body)
+	data, err := readBody(resp, MaxImageBytes)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFetchData, err)
+		return nil, err
 	}
-	defer data.Close()
 
-	image, err := data.Optimize(imgdiet.DefaultOptions())
+	if mediatype.Detect(data) == "" {
+		return nil, fmt.Errorf("%w: %w", ErrFetchData, ErrDecodeImage)
+	}
+
+	optimized, report := c.optimize(data)
+
+	image := newImage(optimized, resp.Header.Get("Content-Type"))
+	image.Optimization = report
+
+	return image, nil
+}
+
+// Probe checks that the server at a URL answers, returning the same errors as
+// Remote. Unlike Remote, it sends a single request that doesn't count against
+// the rate limit, and the image it gets back is neither read nor optimized.
+func (c *Client) Probe(ctx context.Context, uri string) error {
+	resp, err := c.probe.Get(ctx, uri)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFetchData, err)
+		return requestError(err)
+	}
+	defer resp.Body.Close()
+
+	return statusError(resp, uri)
+}
+
+// wait blocks until the rate limit lets a request be sent or ctx is done. A
+// request that can't be sent before ctx's deadline is rate limited by the
+// client itself rather than timed out by the server, so it fails with a
+// RateLimitError saying how long to wait.
+func (c *Client) wait(ctx context.Context) error {
+	reservation := c.limiter.Reserve()
+	if !reservation.OK() {
+		return fmt.Errorf("%w: %w", ErrFetchData, &RateLimitError{})
 	}
 
-	if data.Saved() < resp.ContentLength {
-		return image, nil
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		reservation.Cancel()
+
+		return fmt.Errorf("%w: %w", ErrFetchData, &RateLimitError{RetryAfter: delay})
 	}
 
-	image, err = io.ReadAll(resp.Body)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w: %w", ErrFetchData, &RateLimitError{RetryAfter: delay})
+		}
+
+		return requestError(ctx.Err())
+	}
+}
+
+// requestError returns the error of a request that got no response, wrapped
+// with the error describing why.
+func requestError(err error) error {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w: %w", ErrFetchData, ErrCanceled, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %w: %w", ErrFetchData, ErrTimeout, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrFetchData, err)
+	}
+}
+
+// statusError returns the error matching the status code of a response, or
+// nil if the request succeeded.
+func statusError(resp *http.Response, uri string) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrNotFound, uri)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", ErrFetchData, &RateLimitError{
+			RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		})
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return fmt.Errorf("%w: %w: %s", ErrFetchData, ErrTimeout, resp.Status)
+	default:
+		return fmt.Errorf("%w: %s", ErrFetchData, resp.Status)
+	}
+}
+
+// ParseRetryAfter returns the delay given by the value of a Retry-After header,
+// either in seconds or as an HTTP date relative to now. It returns zero if the
+// value is empty, invalid, or in the past.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	date, err := http.ParseTime(value)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFetchData, err)
+		return 0
 	}
 
-	return image, nil
+	return max(date.Sub(now), 0)
+}
+
+// newImage returns an Image for the given data. Its media type is detected
+// from the data itself, falling back to the one announced by the server.
+func newImage(data []byte, contentType string) *Image {
+	mediaType := mediatype.Detect(data)
+
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(contentType)
+	}
+
+	return &Image{
+		ContentType: mediaType,
+		Data:        data,
+	}
 }
@@ -3,7 +3,12 @@ package fetch_test
 import (
 	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
 )
@@ -11,7 +16,26 @@ import (
 func TestClient_Remote(t *testing.T) {
 	t.Parallel()
 
-	client := fetch.New("TestService", "test@example.com")
+	avatar, err := os.ReadFile("testdata/avatar.png")
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	var (
+		client = fetch.New("TestService", "test@example.com", nil)
+		found  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(avatar)
+		}))
+		forbidden = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		missing = httptest.NewServer(http.NotFoundHandler())
+	)
+
+	t.Cleanup(found.Close)
+	t.Cleanup(forbidden.Close)
+	t.Cleanup(missing.Close)
 
 	tests := []struct {
 		name          string
@@ -20,13 +44,18 @@ func TestClient_Remote(t *testing.T) {
 	}{
 		{
 			name: "Successful fetch",
-			uri:  "https://s.gravatar.com/avatar/c9fb2194c5e620c85b10840bc63121fd984ed86e91bc819d5dad7baf1168e5c1",
+			uri:  found.URL + "/avatar/c9fb2194c5e620c85b10840bc63121fd984ed86e91bc819d5dad7baf1168e5c1",
 		},
 		{
 			name:          "Unsuccessful fetch",
-			uri:           "https://s.gravatar.com/avat",
+			uri:           forbidden.URL + "/avatar",
 			expectedError: fetch.ErrFetchData,
 		},
+		{
+			name:          "Not found",
+			uri:           missing.URL + "/avatar",
+			expectedError: fetch.ErrNotFound,
+		},
 		{
 			name:          "Invalid URL",
 			uri:           "://invalid.url",
@@ -41,7 +70,7 @@ func TestClient_Remote(t *testing.T) {
 			t.Parallel()
 
 			ctx := context.Background()
-			data, err := client.Remote(ctx, tt.uri)
+			image, err := client.Remote(ctx, tt.uri)
 
 			if tt.expectedError != nil {
 				if !errors.Is(err, tt.expectedError) {
@@ -52,12 +81,175 @@ func TestClient_Remote(t *testing.T) {
 			}
 
 			if err != nil {
-				t.Errorf("unexpected error: %v", err)
+				t.Fatalf("unexpected error: %v", err)
 			}
 
-			if len(data) == 0 {
+			if len(image.Data) == 0 {
 				t.Errorf("expected non-empty data, got empty")
 			}
+
+			if image.ContentType == "" {
+				t.Errorf("expected a content type, got empty")
+			}
+		})
+	}
+}
+
+func TestClient_SetRateLimit(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	t.Cleanup(server.Close)
+
+	client := fetch.New("TestService", "test@example.com", nil)
+
+	// A 404 is never retried, so only the first attempt of each request is
+	// limited: the first is sent right away and the others wait 100ms each.
+	client.SetRateLimit(10, 1)
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Remote(context.Background(), server.URL); !errors.Is(err, fetch.ErrNotFound) {
+			t.Fatalf("expected error %v, got %v", fetch.ErrNotFound, err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected requests over the limit to be delayed, took %s", elapsed)
+	}
+
+	// A request that can't be sent before its deadline is rate limited by the
+	// client itself, not timed out by the server.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var rateLimit *fetch.RateLimitError
+
+	_, err := client.Remote(ctx, server.URL)
+	if !errors.Is(err, fetch.ErrFetchData) || !errors.As(err, &rateLimit) {
+		t.Fatalf("expected errors %v and %v, got %v", fetch.ErrFetchData, fetch.ErrRateLimited, err)
+	}
+
+	if errors.Is(err, fetch.ErrTimeout) {
+		t.Errorf("expected no %v, got %v", fetch.ErrTimeout, err)
+	}
+
+	if rateLimit.RetryAfter <= 0 {
+		t.Errorf("expected a positive retry delay, got %s", rateLimit.RetryAfter)
+	}
+}
+
+func TestClient_SetRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	t.Cleanup(server.Close)
+
+	client := fetch.New("TestService", "test@example.com", nil)
+	client.SetRateLimit(1000, 10)
+	client.SetRetryPolicy(2, time.Millisecond)
+
+	start := time.Now()
+
+	if _, err := client.Remote(context.Background(), server.URL); !errors.Is(err, fetch.ErrFetchData) {
+		t.Fatalf("expected error %v, got %v", fetch.ErrFetchData, err)
+	}
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected 2 attempts, got %d", got)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected retries to wait at most the given delay, took %s", elapsed)
+	}
+}
+
+func TestClient_Probe(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	t.Cleanup(server.Close)
+
+	client := fetch.New("TestService", "test@example.com", nil)
+	client.SetRateLimit(0.1, 1)
+
+	if _, err := client.Remote(context.Background(), server.URL); !errors.Is(err, fetch.ErrNotFound) {
+		t.Fatalf("expected error %v, got %v", fetch.ErrNotFound, err)
+	}
+
+	// The rate limit is used up, but probes don't wait for it.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.Probe(ctx, server.URL); !errors.Is(err, fetch.ErrNotFound) {
+		t.Errorf("expected error %v, got %v", fetch.ErrNotFound, err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, time.May, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{
+			name:  "Empty",
+			value: "",
+			want:  0,
+		},
+		{
+			name:  "Seconds",
+			value: "120",
+			want:  2 * time.Minute,
+		},
+		{
+			name:  "Negative seconds",
+			value: "-5",
+			want:  0,
+		},
+		{
+			name:  "HTTP date",
+			value: "Tue, 16 May 2023 12:00:30 GMT",
+			want:  30 * time.Second,
+		},
+		{
+			name:  "HTTP date in the past",
+			value: "Tue, 16 May 2023 11:00:00 GMT",
+			want:  0,
+		},
+		{
+			name:  "Invalid",
+			value: "soon",
+			want:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := fetch.ParseRetryAfter(tt.value, now); got != tt.want {
+				t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+			}
 		})
 	}
 }
@@ -0,0 +1,126 @@
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"git.sr.ht/~jamesponddotco/imgdiet-go"
+)
+
+// MaxImageBytes is the maximum size in bytes of an image fetched from an
+// upstream. The whole image is kept in memory to compare it with its optimized
+// version, so larger images are refused.
+const MaxImageBytes int64 = 10 << 20
+
+// Options defines how fetched and resized images are optimized.
+type Options struct {
+	// Optimize defines whether fetched images are optimized at all. Resized
+	// images are always encoded with the other options.
+	Optimize bool
+
+	// Quality is the quality of optimized images, between 1 and 100.
+	Quality uint
+
+	// Compression is the compression level of optimized PNG images, between
+	// 1 and 9.
+	Compression uint
+
+	// StripMetadata defines whether metadata is removed from optimized
+	// images.
+	StripMetadata bool
+}
+
+// DefaultOptions returns the options used when none are given, matching
+// imgdiet's defaults.
+func DefaultOptions() *Options {
+	defaults := imgdiet.DefaultOptions()
+
+	return &Options{
+		Optimize:      true,
+		Quality:       defaults.Quality,
+		Compression:   defaults.Compression,
+		StripMetadata: defaults.StripMetadata,
+	}
+}
+
+// imgdietOptions returns the imgdiet options matching the given options,
+// keeping imgdiet's defaults for the settings that can't be configured.
+func (o *Options) imgdietOptions() *imgdiet.Options {
+	opts := imgdiet.DefaultOptions()
+
+	opts.Quality = o.Quality
+	opts.Compression = o.Compression
+	opts.StripMetadata = o.StripMetadata
+
+	return opts
+}
+
+// Optimization reports the outcome of optimizing a fetched image.
+type Optimization struct {
+	// OriginalBytes is the size in bytes of the image as it was fetched.
+	OriginalBytes int
+
+	// OptimizedBytes is the size in bytes of the optimized image. Zero if the
+	// image couldn't be optimized.
+	OptimizedBytes int
+
+	// Optimized defines whether the optimized image was picked over the
+	// original, which only happens when it is smaller.
+	Optimized bool
+}
+
+// optimize returns the smaller of an image and its optimized version, along
+// with a report of which one was picked. The image itself is returned if
+// optimization is disabled or it can't be optimized, such as when imgdiet
+// doesn't support its format.
+func (c *Client) optimize(data []byte) ([]byte, *Optimization) {
+	report := &Optimization{
+		OriginalBytes: len(data),
+	}
+
+	if !c.options.Optimize {
+		return data, report
+	}
+
+	img, err := imgdiet.Open(bytes.NewReader(data))
+	if err != nil {
+		return data, report
+	}
+	defer img.Close()
+
+	optimized, err := img.Optimize(c.options.imgdietOptions())
+	if err != nil {
+		return data, report
+	}
+
+	report.OptimizedBytes = len(optimized)
+
+	if len(optimized) == 0 || len(optimized) >= len(data) {
+		return data, report
+	}
+
+	report.Optimized = true
+
+	return optimized, report
+}
+
+// readBody reads the body of a response, refusing bodies larger than maxBytes.
+// Bodies of unknown length, such as chunked ones, are read up to the limit.
+func readBody(resp *http.Response, maxBytes int64) ([]byte, error) {
+	if resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("%w: %w", ErrFetchData, ErrImageTooLarge)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, requestError(err)
+	}
+
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%w: %w", ErrFetchData, ErrImageTooLarge)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,141 @@
+package fetch_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+)
+
+func TestClient_Remote_Optimization(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 0x80, A: 0xFF})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	original := buf.Bytes()
+
+	tests := []struct {
+		name          string
+		body          []byte
+		expectedError error
+	}{
+		{
+			name: "Chunked response",
+			body: original,
+		},
+		{
+			name:          "Image too large",
+			body:          make([]byte, fetch.MaxImageBytes+1),
+			expectedError: fetch.ErrImageTooLarge,
+		},
+		{
+			name:          "Not an image",
+			body:          []byte("not an image"),
+			expectedError: fetch.ErrDecodeImage,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Flushing before writing the body leaves the response without a
+			// Content-Length, so it is sent chunked.
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.(http.Flusher).Flush()
+
+				_, _ = w.Write(tt.body)
+			}))
+			t.Cleanup(server.Close)
+
+			client := fetch.New("TestService", "test@example.com", nil)
+
+			got, err := client.Remote(context.Background(), server.URL)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+
+			if tt.expectedError != nil {
+				return
+			}
+
+			report := got.Optimization
+			if report == nil {
+				t.Fatal("expected an optimization report, got nil")
+			}
+
+			if report.OriginalBytes != len(original) {
+				t.Errorf("expected original size %d, got %d", len(original), report.OriginalBytes)
+			}
+
+			want := report.OriginalBytes
+			if report.Optimized {
+				want = report.OptimizedBytes
+			}
+
+			if len(got.Data) != want || len(got.Data) > len(original) {
+				t.Errorf("expected the smaller image of %d bytes, got %d bytes", want, len(got.Data))
+			}
+		})
+	}
+}
+
+func TestClient_Remote_OptimizationDisabled(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 0x80, A: 0xFF})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	opts := fetch.DefaultOptions()
+	opts.Optimize = false
+
+	client := fetch.New("TestService", "test@example.com", opts)
+
+	got, err := client.Remote(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got.Data, buf.Bytes()) {
+		t.Errorf("expected the original image, got %d bytes instead of %d", len(got.Data), buf.Len())
+	}
+
+	if got.Optimization.Optimized {
+		t.Errorf("expected the original image to be picked, got the optimized one")
+	}
+}
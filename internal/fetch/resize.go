@@ -0,0 +1,34 @@
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+
+	"git.sr.ht/~jamesponddotco/imgdiet-go"
+)
+
+// Resize scales an image down to a square of the given size, cropping it from
+// the center if it isn't square, and encodes the result with the client's
+// options. Images that already fit are returned as they are.
+func (c *Client) Resize(image *Image, size int) (*Image, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("%w: invalid size %d", ErrResizeImage, size)
+	}
+
+	img, err := imgdiet.Open(bytes.NewReader(image.Data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrResizeImage, err)
+	}
+	defer img.Close()
+
+	if img.Width() <= size && img.Height() <= size {
+		return image, nil
+	}
+
+	data, err := img.Resize(uint(size), uint(size), c.options.imgdietOptions())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrResizeImage, err)
+	}
+
+	return newImage(data, image.ContentType), nil
+}
@@ -0,0 +1,98 @@
+package fetch_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+)
+
+func TestResize(t *testing.T) {
+	t.Parallel()
+
+	client := fetch.New("TestService", "test@example.com", nil)
+
+	tests := []struct {
+		name          string
+		width         int
+		height        int
+		size          int
+		wantWidth     int
+		wantHeight    int
+		expectedError error
+	}{
+		{
+			name:       "Scale down",
+			width:      64,
+			height:     64,
+			size:       16,
+			wantWidth:  16,
+			wantHeight: 16,
+		},
+		{
+			name:       "Crop non-square image",
+			width:      64,
+			height:     32,
+			size:       16,
+			wantWidth:  16,
+			wantHeight: 16,
+		},
+		{
+			name:       "Image already fits",
+			width:      32,
+			height:     32,
+			size:       64,
+			wantWidth:  32,
+			wantHeight: 32,
+		},
+		{
+			name:          "Invalid size",
+			width:         32,
+			height:        32,
+			size:          0,
+			expectedError: fetch.ErrResizeImage,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			img := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			for x := 0; x < tt.width; x++ {
+				for y := 0; y < tt.height; y++ {
+					img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 0x80, A: 0xFF})
+				}
+			}
+
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				t.Fatalf("Setup error: %v", err)
+			}
+
+			resized, err := client.Resize(&fetch.Image{ContentType: "image/png", Data: buf.Bytes()}, tt.size)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+
+			if tt.expectedError != nil {
+				return
+			}
+
+			config, err := png.DecodeConfig(bytes.NewReader(resized.Data))
+			if err != nil {
+				t.Fatalf("failed to decode resized image: %v", err)
+			}
+
+			if config.Width != tt.wantWidth || config.Height != tt.wantHeight {
+				t.Errorf("expected %dx%d image, got %dx%d", tt.wantWidth, tt.wantHeight, config.Width, config.Height)
+			}
+		})
+	}
+}
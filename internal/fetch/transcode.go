@@ -0,0 +1,122 @@
+package fetch
+
+import (
+	"fmt"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/mediatype"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// ErrTranscodeImage is returned when an image can't be converted to
+	// another format.
+	ErrTranscodeImage xerrors.Error = "failed to transcode image"
+
+	// ErrUnsupportedMediaType is returned when an image can't be converted to
+	// the requested media type.
+	ErrUnsupportedMediaType xerrors.Error = "unsupported media type"
+)
+
+// TranscodeTargets lists the media types images are converted to when clients
+// accept them, in order of preference.
+var TranscodeTargets = []string{mediatype.AVIF, mediatype.WebP}
+
+// CanTranscode returns true if images can be converted to the given media
+// type.
+func CanTranscode(mediaType string) bool {
+	switch mediaType {
+	case mediatype.JPEG, mediatype.PNG, mediatype.GIF, mediatype.WebP, mediatype.AVIF:
+		return true
+	default:
+		return false
+	}
+}
+
+// Transcode converts an image to one of the media types supported by
+// CanTranscode, like Convert, unless the result is larger than the image
+// itself, in which case the image is returned as it is.
+func (c *Client) Transcode(image *Image, mediaType string) (*Image, error) {
+	converted, err := c.Convert(image, mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	if len(converted.Data) >= len(image.Data) {
+		return image, nil
+	}
+
+	return converted, nil
+}
+
+// Convert converts an image to one of the media types supported by
+// CanTranscode, encoding it with the client's quality, compression level, and
+// metadata settings. Transparent images converted to JPEG are flattened
+// against a white background.
+//
+// imgdiet only converts between JPEG and PNG images, so libvips is used
+// directly.
+func (c *Client) Convert(image *Image, mediaType string) (*Image, error) {
+	if !CanTranscode(mediaType) {
+		return nil, fmt.Errorf("%w: %w: %s", ErrTranscodeImage, ErrUnsupportedMediaType, mediaType)
+	}
+
+	ref, err := vips.NewImageFromBuffer(image.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTranscodeImage, err)
+	}
+	defer ref.Close()
+
+	var (
+		data    []byte
+		quality = int(c.options.Quality)
+		strip   = c.options.StripMetadata
+	)
+
+	switch mediaType {
+	case mediatype.JPEG:
+		if ref.HasAlpha() {
+			if err = ref.Flatten(&vips.Color{R: 0xFF, G: 0xFF, B: 0xFF}); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrTranscodeImage, err)
+			}
+		}
+
+		params := vips.NewJpegExportParams()
+		params.Quality = quality
+		params.StripMetadata = strip
+
+		data, _, err = ref.ExportJpeg(params)
+	case mediatype.PNG:
+		params := vips.NewPngExportParams()
+		params.Compression = int(c.options.Compression)
+		params.StripMetadata = strip
+
+		data, _, err = ref.ExportPng(params)
+	case mediatype.GIF:
+		params := vips.NewGifExportParams()
+		params.StripMetadata = strip
+
+		data, _, err = ref.ExportGIF(params)
+	case mediatype.WebP:
+		params := vips.NewWebpExportParams()
+		params.Quality = quality
+		params.StripMetadata = strip
+
+		data, _, err = ref.ExportWebp(params)
+	case mediatype.AVIF:
+		params := vips.NewAvifExportParams()
+		params.Quality = quality
+		params.StripMetadata = strip
+
+		data, _, err = ref.ExportAvif(params)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTranscodeImage, err)
+	}
+
+	return &Image{
+		ContentType: mediaType,
+		Data:        data,
+	}, nil
+}
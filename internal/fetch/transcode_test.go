@@ -0,0 +1,185 @@
+package fetch_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+	"git.sr.ht/~jamesponddotco/privytar/internal/mediatype"
+)
+
+func TestClient_Convert(t *testing.T) {
+	t.Parallel()
+
+	var (
+		client = fetch.New("TestService", "test@example.com", nil)
+		source = &fetch.Image{
+			ContentType: mediatype.PNG,
+			Data:        encodeTestPNG(t, noisyImage(32)),
+		}
+	)
+
+	tests := []struct {
+		name          string
+		mediaType     string
+		expectedError error
+	}{
+		{
+			name:      "WebP",
+			mediaType: mediatype.WebP,
+		},
+		{
+			name:      "AVIF",
+			mediaType: mediatype.AVIF,
+		},
+		{
+			name:      "JPEG",
+			mediaType: mediatype.JPEG,
+		},
+		{
+			name:          "Unsupported media type",
+			mediaType:     "image/bmp",
+			expectedError: fetch.ErrUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			transcoded, err := client.Convert(source, tt.mediaType)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+
+			if tt.expectedError != nil {
+				return
+			}
+
+			if transcoded.ContentType != tt.mediaType {
+				t.Errorf("expected content type %q, got %q", tt.mediaType, transcoded.ContentType)
+			}
+
+			if got := mediatype.Detect(transcoded.Data); got != tt.mediaType {
+				t.Errorf("expected data of type %q, got %q", tt.mediaType, got)
+			}
+		})
+	}
+}
+
+func TestClient_Convert_Options(t *testing.T) {
+	t.Parallel()
+
+	source := &fetch.Image{
+		ContentType: mediatype.PNG,
+		Data:        encodeTestPNG(t, noisyImage(64)),
+	}
+
+	convert := func(quality uint) int {
+		t.Helper()
+
+		opts := fetch.DefaultOptions()
+		opts.Quality = quality
+
+		converted, err := fetch.New("TestService", "test@example.com", opts).Convert(source, mediatype.WebP)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return len(converted.Data)
+	}
+
+	if low, high := convert(10), convert(95); low >= high {
+		t.Errorf("expected quality 10 to be smaller than quality 95, got %d and %d bytes", low, high)
+	}
+}
+
+func TestClient_Transcode(t *testing.T) {
+	t.Parallel()
+
+	client := fetch.New("TestService", "test@example.com", nil)
+
+	tests := []struct {
+		name            string
+		image           image.Image
+		mediaType       string
+		wantContentType string
+	}{
+		{
+			name:            "Smaller variant",
+			image:           noisyImage(32),
+			mediaType:       mediatype.WebP,
+			wantContentType: mediatype.WebP,
+		},
+		{
+			// A blank image compresses to almost nothing as a PNG, less
+			// than the AVIF container alone.
+			name:            "Larger variant",
+			image:           image.NewRGBA(image.Rect(0, 0, 32, 32)),
+			mediaType:       mediatype.AVIF,
+			wantContentType: mediatype.PNG,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := &fetch.Image{
+				ContentType: mediatype.PNG,
+				Data:        encodeTestPNG(t, tt.image),
+			}
+
+			transcoded, err := client.Transcode(source, tt.mediaType)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if transcoded.ContentType != tt.wantContentType {
+				t.Errorf("expected content type %q, got %q", tt.wantContentType, transcoded.ContentType)
+			}
+
+			if len(transcoded.Data) > len(source.Data) {
+				t.Errorf("expected at most %d bytes, got %d", len(source.Data), len(transcoded.Data))
+			}
+		})
+	}
+}
+
+// noisyImage returns a square image of the given size filled with random
+// pixels, which lossy formats compress far better than PNG.
+func noisyImage(size int) image.Image {
+	var (
+		rng = rand.New(rand.NewSource(1)) //nolint:gosec // deterministic test data
+		img = image.NewRGBA(image.Rect(0, 0, size, size))
+	)
+
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: 0x80, A: 0xFF})
+		}
+	}
+
+	return img
+}
+
+// encodeTestPNG returns the given image encoded as a PNG.
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,186 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/httpx-go"
+	"git.sr.ht/~jamesponddotco/imgdiet-go"
+	"git.sr.ht/~jamesponddotco/privytar/internal/mediatype"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+// MaxUntrustedPixels is the maximum number of pixels of an image fetched by
+// Untrusted. A small file can decode to a huge image, so the decoded dimensions
+// are checked before the image is optimized, resized, or transcoded.
+const MaxUntrustedPixels = 4096 * 4096
+
+const (
+	// ErrForbiddenAddress is returned when an untrusted URL resolves to an
+	// address that isn't publicly routable.
+	ErrForbiddenAddress xerrors.Error = "address is not allowed"
+
+	// ErrImageTooLarge is returned when an image is larger than the maximum
+	// size allowed.
+	ErrImageTooLarge xerrors.Error = "image is too large"
+
+	// ErrNotImage is returned when the data fetched from a URL isn't an image.
+	ErrNotImage xerrors.Error = "data is not an image"
+)
+
+// _nonPublicPrefixes are address ranges reserved for special use that aren't
+// covered by the netip.Addr predicates checked in checkAddress.
+var _nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// newUntrustedHTTPClient returns an HTTP client suitable for fetching URLs
+// provided by users, which refuses to connect to loopback, private, and other
+// non-public addresses.
+func newUntrustedHTTPClient(userAgent *httpx.UserAgent) *httpx.Client {
+	transport := httpx.DefaultTransport()
+
+	// The address is checked after the host is resolved, right before
+	// connecting, so DNS tricks can't be used to bypass it. Proxies are
+	// disabled since the check would apply to the proxy instead.
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkAddress,
+	}).DialContext
+
+	return &httpx.Client{
+		RetryPolicy: newRetryPolicy(MaxAttempts, MaxRetryDelay),
+		UserAgent:   userAgent,
+		Transport:   transport,
+	}
+}
+
+// SetUntrustedTransport replaces the transport used by Untrusted, such as to
+// route requests to a test server. The given transport skips the address
+// check, so it must never be used to fetch URLs provided by users.
+func (c *Client) SetUntrustedTransport(transport http.RoundTripper) {
+	c.untrusted.Transport = transport
+}
+
+// Untrusted fetches an image from a URL provided by a user, such as a custom
+// default image, and optimizes it to reduce its size.
+//
+// Unlike Remote, it refuses to connect to non-public addresses, to download
+// images larger than maxBytes, and to accept images with more than
+// MaxUntrustedPixels pixels.
+func (c *Client) Untrusted(ctx context.Context, uri string, maxBytes int64) (*Image, error) {
+	resp, err := c.untrusted.Get(ctx, uri)
+	if err != nil {
+		return nil, requestError(err)
+	}
+	defer resp.Body.Close()
+
+	if err = statusError(resp, uri); err != nil {
+		return nil, err
+	}
+
+	data, err := readBody(resp, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediatype.Detect(data) == "" {
+		return nil, fmt.Errorf("%w: %w", ErrFetchData, ErrNotImage)
+	}
+
+	if err = checkPixels(data); err != nil {
+		return nil, err
+	}
+
+	optimized, report := c.optimize(data)
+
+	image := newImage(optimized, "")
+	image.Optimization = report
+
+	return image, nil
+}
+
+// checkPixels returns an error if the image can't be opened or its dimensions
+// exceed MaxUntrustedPixels. Only the image header is read, so the pixels
+// aren't decoded.
+func checkPixels(data []byte) error {
+	img, err := imgdiet.Open(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrFetchData, ErrNotImage, err)
+	}
+	defer img.Close()
+
+	width, height := img.Width(), img.Height()
+
+	if width < 1 || height < 1 {
+		return fmt.Errorf("%w: %w", ErrFetchData, ErrNotImage)
+	}
+
+	if width > MaxUntrustedPixels/height {
+		return fmt.Errorf("%w: %w: %dx%d pixels", ErrFetchData, ErrImageTooLarge, width, height)
+	}
+
+	return nil
+}
+
+// checkAddress is a net.Dialer control function that refuses connections to
+// addresses that aren't publicly routable.
+func checkAddress(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrForbiddenAddress, err)
+	}
+
+	if !IsPublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr())
+	}
+
+	return nil
+}
+
+// IsPublicAddress returns true if the address is publicly routable, that is,
+// it isn't a loopback, private, link-local, multicast, or otherwise reserved
+// address.
+func IsPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsValid() ||
+		addr.IsUnspecified() ||
+		addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+
+	for _, prefix := range _nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,190 @@
+package fetch_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+)
+
+func TestClient_Untrusted(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		_, _ = w.Write([]byte("GIF89a"))
+	}))
+	t.Cleanup(server.Close)
+
+	// A blank image compresses to a few kilobytes, but decodes to more pixels
+	// than allowed.
+	var large bytes.Buffer
+
+	if err := png.Encode(&large, image.NewGray(image.Rect(0, 0, 8192, 4096))); err != nil {
+		t.Fatal(err)
+	}
+
+	largeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(large.Bytes())
+	}))
+	t.Cleanup(largeServer.Close)
+
+	var (
+		client = fetch.New("TestService", "test@example.com", nil)
+
+		// The test server listens on a loopback address, so this client
+		// skips the address check to reach it.
+		unchecked = fetch.New("TestService", "test@example.com", nil)
+	)
+
+	unchecked.SetUntrustedTransport(http.DefaultTransport)
+
+	tests := []struct {
+		name          string
+		client        *fetch.Client
+		uri           string
+		maxBytes      int64
+		expectedError error
+	}{
+		{
+			name:          "Loopback address",
+			uri:           server.URL,
+			maxBytes:      1024,
+			expectedError: fetch.ErrForbiddenAddress,
+		},
+		{
+			name:          "Private address",
+			uri:           "http://10.0.0.1/avatar.png",
+			maxBytes:      1024,
+			expectedError: fetch.ErrForbiddenAddress,
+		},
+		{
+			name:          "6to4 address",
+			uri:           "http://[2002:7f00:1::1]/avatar.png",
+			maxBytes:      1024,
+			expectedError: fetch.ErrForbiddenAddress,
+		},
+		{
+			name:          "Image too large",
+			client:        unchecked,
+			uri:           server.URL,
+			maxBytes:      1,
+			expectedError: fetch.ErrImageTooLarge,
+		},
+		{
+			name:          "Too many pixels",
+			client:        unchecked,
+			uri:           largeServer.URL,
+			maxBytes:      fetch.MaxImageBytes,
+			expectedError: fetch.ErrImageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := tt.client
+			if c == nil {
+				c = client
+			}
+
+			_, err := c.Untrusted(context.Background(), tt.uri, tt.maxBytes)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestIsPublicAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		addr string
+		want bool
+	}{
+		{
+			name: "Public IPv4",
+			addr: "192.0.78.9",
+			want: true,
+		},
+		{
+			name: "Public IPv6",
+			addr: "2606:4700::6810:84e5",
+			want: true,
+		},
+		{
+			name: "Loopback IPv4",
+			addr: "127.0.0.1",
+		},
+		{
+			name: "Loopback IPv6",
+			addr: "::1",
+		},
+		{
+			name: "Private IPv4",
+			addr: "192.168.1.1",
+		},
+		{
+			name: "Unique local IPv6",
+			addr: "fd00::1",
+		},
+		{
+			name: "Link-local IPv4",
+			addr: "169.254.169.254",
+		},
+		{
+			name: "Unspecified",
+			addr: "0.0.0.0",
+		},
+		{
+			name: "Shared address space",
+			addr: "100.64.0.1",
+		},
+		{
+			name: "IPv4-mapped loopback",
+			addr: "::ffff:127.0.0.1",
+		},
+		{
+			name: "NAT64 prefix",
+			addr: "64:ff9b::7f00:1",
+		},
+		{
+			name: "Local-use NAT64 prefix",
+			addr: "64:ff9b:1::7f00:1",
+		},
+		{
+			name: "6to4 prefix",
+			addr: "2002:7f00:1::1",
+		},
+		{
+			// The client address 127.0.0.1, obfuscated as Teredo does.
+			name: "Teredo prefix",
+			addr: "2001:0:4136:e378:8000:63bf:80ff:fffe",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := fetch.IsPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("IsPublicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
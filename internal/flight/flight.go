@@ -0,0 +1,90 @@
+// Package flight provides a mechanism to collapse concurrent calls for the same
+// key into a single execution whose result is shared by every caller.
+package flight
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+// ErrPanic is returned to every caller when the shared function panics.
+const ErrPanic xerrors.Error = "shared call panicked"
+
+// call represents an in-flight or completed execution of a function.
+type call[T any] struct {
+	// done is closed once the function returns.
+	done chan struct{}
+
+	// val is the value returned by the function.
+	val T
+
+	// err is the error returned by the function.
+	err error
+}
+
+// Group represents a set of keyed calls. The zero value is ready to use.
+type Group[T any] struct {
+	// calls is a map of keys to in-flight calls.
+	calls map[string]*call[T]
+
+	// mu is a mutex to ensure thread safety.
+	mu sync.Mutex
+}
+
+// Do executes fn and returns its results, making sure only one execution is in
+// flight for the given key at a time. Callers arriving while fn is running
+// wait for it and receive the same results, in which case shared is true.
+//
+// fn runs in its own goroutine and isn't bound to ctx, so a caller giving up
+// doesn't cancel the work other callers are waiting for. Callers stop waiting
+// and return the context's error when ctx is done.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func() (T, error)) (val T, shared bool, err error) {
+	g.mu.Lock()
+
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+
+	c, shared := g.calls[key]
+	if !shared {
+		c = &call[T]{
+			done: make(chan struct{}),
+		}
+
+		g.calls[key] = c
+
+		go g.run(key, c, fn)
+	}
+
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		var zero T
+
+		return zero, shared, fmt.Errorf("%w", ctx.Err())
+	}
+}
+
+// run executes fn, records its results, and releases the callers waiting for
+// them.
+func (g *Group[T]) run(key string, c *call[T], fn func() (T, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("%w: %v", ErrPanic, r)
+		}
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+
+		close(c.done)
+	}()
+
+	c.val, c.err = fn()
+}
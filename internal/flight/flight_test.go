@@ -0,0 +1,142 @@
+package flight_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/flight"
+)
+
+func TestGroup_Do(t *testing.T) {
+	t.Parallel()
+
+	var (
+		group   flight.Group[string]
+		calls   atomic.Int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	const callers = 10
+
+	results := make([]string, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			val, _, err := group.Do(context.Background(), "key", func() (string, error) {
+				calls.Add(1)
+
+				<-release
+
+				return "value", nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			results[i] = val
+		}(i)
+	}
+
+	// Give every caller time to join the in-flight call before releasing it.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected fn to be called once, got %d", got)
+	}
+
+	for i, val := range results {
+		if val != "value" {
+			t.Errorf("caller %d: expected %q, got %q", i, "value", val)
+		}
+	}
+}
+
+func TestGroup_Do_Error(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		fn      func() (string, error)
+		wantErr error
+	}{
+		{
+			name: "returned error",
+			fn: func() (string, error) {
+				return "", context.DeadlineExceeded
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "panic",
+			fn: func() (string, error) {
+				panic("boom")
+			},
+			wantErr: flight.ErrPanic,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var group flight.Group[string]
+
+			_, shared, err := group.Do(context.Background(), "key", tt.fn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if shared {
+				t.Errorf("expected first call not to be shared")
+			}
+		})
+	}
+}
+
+func TestGroup_Do_ContextCanceled(t *testing.T) {
+	t.Parallel()
+
+	var (
+		group   flight.Group[string]
+		release = make(chan struct{})
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := group.Do(ctx, "key", func() (string, error) {
+		<-release
+
+		return "value", nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+
+	// The call keeps running for other callers after the first one gave up.
+	go close(release)
+
+	val, _, err := group.Do(context.Background(), "key", func() (string, error) {
+		return "other", nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if val != "value" && val != "other" {
+		t.Errorf("unexpected value %q", val)
+	}
+}
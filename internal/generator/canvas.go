@@ -0,0 +1,139 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/vector"
+)
+
+// _kappa is the distance of the control points from the ends of a cubic Bézier
+// curve approximating a quarter of a circle of radius 1.
+const _kappa float32 = 0.5522848
+
+// point represents a position on the canvas in normalized coordinates, where
+// (0, 0) is the top-left corner and (1, 1) the bottom-right one.
+type point struct {
+	x, y float32
+}
+
+// canvas is a square image that shapes are drawn on using normalized
+// coordinates, so renderers don't depend on the size of the output.
+type canvas struct {
+	// img is the image being drawn.
+	img *image.RGBA
+
+	// rasterizer is reused between shapes to avoid reallocating its buffers.
+	rasterizer *vector.Rasterizer
+
+	// size is the width and height of the image in pixels.
+	size float32
+}
+
+// newCanvas returns a fully transparent canvas of the given size.
+func newCanvas(size int) *canvas {
+	return &canvas{
+		img:        image.NewRGBA(image.Rect(0, 0, size, size)),
+		rasterizer: vector.NewRasterizer(size, size),
+		size:       float32(size),
+	}
+}
+
+// fill paints the whole canvas with the given color.
+func (c *canvas) fill(col color.Color) {
+	draw.Draw(c.img, c.img.Bounds(), image.NewUniform(col), image.Point{}, draw.Src)
+}
+
+// rect draws a rectangle with its top-left corner at (x, y).
+func (c *canvas) rect(col color.Color, x, y, w, h float32) {
+	c.polygon(col, point{x, y}, point{x + w, y}, point{x + w, y + h}, point{x, y + h})
+}
+
+// polygon draws a closed polygon through the given points.
+func (c *canvas) polygon(col color.Color, points ...point) {
+	c.path(points...)
+	c.draw(col)
+}
+
+// polygons draws several closed polygons in the same color at once, which is
+// considerably faster than drawing them one by one.
+func (c *canvas) polygons(col color.Color, shapes [][]point) {
+	if len(shapes) == 0 {
+		return
+	}
+
+	for _, points := range shapes {
+		c.path(points...)
+	}
+
+	c.draw(col)
+}
+
+// ellipse draws an ellipse centered at (cx, cy) with radii rx and ry.
+func (c *canvas) ellipse(col color.Color, cx, cy, rx, ry float32) {
+	var (
+		r  = c.rasterizer
+		s  = c.size
+		kx = rx * _kappa
+		ky = ry * _kappa
+	)
+
+	r.MoveTo((cx+rx)*s, cy*s)
+	r.CubeTo((cx+rx)*s, (cy+ky)*s, (cx+kx)*s, (cy+ry)*s, cx*s, (cy+ry)*s)
+	r.CubeTo((cx-kx)*s, (cy+ry)*s, (cx-rx)*s, (cy+ky)*s, (cx-rx)*s, cy*s)
+	r.CubeTo((cx-rx)*s, (cy-ky)*s, (cx-kx)*s, (cy-ry)*s, cx*s, (cy-ry)*s)
+	r.CubeTo((cx+kx)*s, (cy-ry)*s, (cx+rx)*s, (cy-ky)*s, (cx+rx)*s, cy*s)
+	r.ClosePath()
+
+	c.draw(col)
+}
+
+// path adds a closed polygon to the current path without drawing it.
+func (c *canvas) path(points ...point) {
+	if len(points) == 0 {
+		return
+	}
+
+	c.rasterizer.MoveTo(points[0].x*c.size, points[0].y*c.size)
+
+	for _, p := range points[1:] {
+		c.rasterizer.LineTo(p.x*c.size, p.y*c.size)
+	}
+
+	c.rasterizer.ClosePath()
+}
+
+// draw fills the current path with the given color and starts a new one.
+func (c *canvas) draw(col color.Color) {
+	c.rasterizer.Draw(c.img, c.img.Bounds(), image.NewUniform(col), image.Point{})
+
+	size := c.img.Bounds().Dx()
+	c.rasterizer.Reset(size, size)
+}
+
+// scale resizes the image to the given size once drawing is done.
+func (c *canvas) scale(size int) {
+	scaled := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	xdraw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), c.img, c.img.Bounds(), draw.Src, nil)
+
+	c.img = scaled
+	c.size = float32(size)
+	c.rasterizer.Reset(size, size)
+}
+
+// encode returns the canvas as a PNG image.
+func (c *canvas) encode() ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, c.img); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,209 @@
+// Package generator renders Gravatar's built-in default images locally, so
+// hashes of users without an avatar don't need to be sent upstream to get one.
+//
+// Images are derived deterministically from the hash: the same hash, style,
+// and size always produce the same image.
+package generator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+const (
+	// ErrUnknownStyle is returned when a default image style isn't known.
+	ErrUnknownStyle xerrors.Error = "unknown default image style"
+
+	// ErrInvalidSize is returned when the requested image size is out of
+	// range.
+	ErrInvalidSize xerrors.Error = "invalid image size"
+)
+
+// List of default image styles supported by the generator, named after the
+// values Gravatar accepts in its d parameter.
+const (
+	StyleMysteryPerson string = "mp"
+	StyleIdenticon     string = "identicon"
+	StyleMonsterID     string = "monsterid"
+	StyleWavatar       string = "wavatar"
+	StyleRetro         string = "retro"
+	StyleRoboHash      string = "robohash"
+	StyleBlank         string = "blank"
+)
+
+// List of legacy names Gravatar still accepts for the mystery person style.
+const (
+	styleMysteryMan      string = "mm"
+	styleMysteryManAlias string = "mysteryman"
+)
+
+// MaxSize is the largest image size, in pixels, the generator renders.
+const MaxSize int = 2048
+
+// MaxDrawSize is the largest size, in pixels, images are drawn at. Larger
+// images are drawn at this size and scaled up, so drawing them costs the same
+// no matter the requested size.
+const MaxDrawSize int = 512
+
+// MediaType is the media type of the images returned by Generate.
+const MediaType string = "image/png"
+
+// renderFunc draws a default image on the canvas using the given seed.
+type renderFunc func(c *canvas, s *seed)
+
+// IsStyle returns true if name is a default image style supported by the
+// generator.
+func IsStyle(name string) bool {
+	_, ok := renderer(name)
+
+	return ok
+}
+
+// Generate renders the default image of the given style for the given hash as
+// a square PNG image of size pixels.
+func Generate(style, hash string, size int) ([]byte, error) {
+	render, ok := renderer(style)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStyle, style)
+	}
+
+	if size < 1 || size > MaxSize {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+
+	c := newCanvas(min(size, MaxDrawSize))
+
+	render(c, newSeed(hash))
+
+	if size > MaxDrawSize {
+		c.scale(size)
+	}
+
+	image, err := c.encode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s image: %w", style, err)
+	}
+
+	return image, nil
+}
+
+// renderer returns the function that renders the given style.
+func renderer(style string) (renderFunc, bool) {
+	switch style {
+	case StyleMysteryPerson, styleMysteryMan, styleMysteryManAlias:
+		return renderMysteryPerson, true
+	case StyleIdenticon:
+		return renderIdenticon, true
+	case StyleMonsterID:
+		return renderMonsterID, true
+	case StyleWavatar:
+		return renderWavatar, true
+	case StyleRetro:
+		return renderRetro, true
+	case StyleRoboHash:
+		return renderRoboHash, true
+	case StyleBlank:
+		return renderBlank, true
+	default:
+		return nil, false
+	}
+}
+
+// renderBlank leaves the canvas fully transparent.
+func renderBlank(_ *canvas, _ *seed) {}
+
+// renderMysteryPerson draws a generic silhouette that doesn't depend on the
+// hash.
+func renderMysteryPerson(c *canvas, _ *seed) {
+	var (
+		background = color.RGBA{R: 0xC8, G: 0xC8, B: 0xC8, A: 0xFF}
+		figure     = color.RGBA{R: 0xF2, G: 0xF2, B: 0xF2, A: 0xFF}
+	)
+
+	c.fill(background)
+	c.ellipse(figure, 0.5, 0.38, 0.18, 0.18)
+	c.ellipse(figure, 0.5, 1.02, 0.36, 0.36)
+}
+
+// seed is a deterministic stream of bytes derived from a hash.
+type seed struct {
+	// state holds the bytes currently being consumed.
+	state [sha256.Size]byte
+
+	// pos is the position of the next byte to consume.
+	pos int
+}
+
+// newSeed returns a seed for the given hash. Hashes are case-insensitive.
+func newSeed(hash string) *seed {
+	return &seed{
+		state: sha256.Sum256([]byte(strings.ToLower(hash))),
+	}
+}
+
+// next returns the next byte of the stream.
+func (s *seed) next() byte {
+	if s.pos == len(s.state) {
+		s.state = sha256.Sum256(s.state[:])
+		s.pos = 0
+	}
+
+	b := s.state[s.pos]
+	s.pos++
+
+	return b
+}
+
+// intn returns a number in [0, n).
+func (s *seed) intn(n int) int {
+	return int(s.next()) % n
+}
+
+// between returns a number in [lower, upper].
+func (s *seed) between(lower, upper float32) float32 {
+	return lower + (upper-lower)*float32(s.next())/math.MaxUint8
+}
+
+// hue returns a hue in degrees.
+func (s *seed) hue() float64 {
+	return float64(s.next()) / (math.MaxUint8 + 1) * 360
+}
+
+// hsl converts a color in the HSL color space, with the hue in degrees and the
+// saturation and lightness in [0, 1], to an opaque RGBA color.
+func hsl(hue, saturation, lightness float64) color.RGBA {
+	var (
+		chroma = (1 - math.Abs(2*lightness-1)) * saturation
+		x      = chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+		m      = lightness - chroma/2
+		r, g   float64
+		b      float64
+	)
+
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * math.MaxUint8)),
+		G: uint8(math.Round((g + m) * math.MaxUint8)),
+		B: uint8(math.Round((b + m) * math.MaxUint8)),
+		A: math.MaxUint8,
+	}
+}
@@ -0,0 +1,213 @@
+package generator_test
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/generator"
+)
+
+const _testHash = "205e460b479e2e5b48aec07710c08d50"
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		style   string
+		size    int
+		wantErr error
+	}{
+		{
+			name:  "Mystery person",
+			style: generator.StyleMysteryPerson,
+			size:  80,
+		},
+		{
+			name:  "Mystery person legacy name",
+			style: "mm",
+			size:  80,
+		},
+		{
+			name:  "Identicon",
+			style: generator.StyleIdenticon,
+			size:  80,
+		},
+		{
+			name:  "MonsterID",
+			style: generator.StyleMonsterID,
+			size:  80,
+		},
+		{
+			name:  "Wavatar",
+			style: generator.StyleWavatar,
+			size:  80,
+		},
+		{
+			name:  "Retro",
+			style: generator.StyleRetro,
+			size:  80,
+		},
+		{
+			name:  "RoboHash",
+			style: generator.StyleRoboHash,
+			size:  80,
+		},
+		{
+			name:  "Blank",
+			style: generator.StyleBlank,
+			size:  80,
+		},
+		{
+			name:  "Smallest size",
+			style: generator.StyleIdenticon,
+			size:  1,
+		},
+		{
+			name:  "Largest size",
+			style: generator.StyleRetro,
+			size:  generator.MaxSize,
+		},
+		{
+			name:    "Unknown style",
+			style:   "unknown",
+			size:    80,
+			wantErr: generator.ErrUnknownStyle,
+		},
+		{
+			name:    "Size too small",
+			style:   generator.StyleIdenticon,
+			size:    0,
+			wantErr: generator.ErrInvalidSize,
+		},
+		{
+			name:    "Size too large",
+			style:   generator.StyleIdenticon,
+			size:    generator.MaxSize + 1,
+			wantErr: generator.ErrInvalidSize,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := generator.Generate(tt.style, _testHash, tt.size)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Generate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			img, err := png.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("Generate() returned an invalid PNG image: %v", err)
+			}
+
+			if bounds := img.Bounds(); bounds.Dx() != tt.size || bounds.Dy() != tt.size {
+				t.Errorf("Generate() size = %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), tt.size, tt.size)
+			}
+
+			again, err := generator.Generate(tt.style, _testHash, tt.size)
+			if err != nil {
+				t.Fatalf("Generate() second call error = %v", err)
+			}
+
+			if !bytes.Equal(got, again) {
+				t.Errorf("Generate() isn't deterministic for style %q", tt.style)
+			}
+		})
+	}
+}
+
+func TestGenerate_Hash(t *testing.T) {
+	t.Parallel()
+
+	styles := []string{
+		generator.StyleIdenticon,
+		generator.StyleMonsterID,
+		generator.StyleWavatar,
+		generator.StyleRetro,
+		generator.StyleRoboHash,
+	}
+
+	for _, style := range styles {
+		style := style
+
+		t.Run(style, func(t *testing.T) {
+			t.Parallel()
+
+			first, err := generator.Generate(style, _testHash, 80)
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+
+			second, err := generator.Generate(style, "00000000000000000000000000000000", 80)
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+
+			if bytes.Equal(first, second) {
+				t.Errorf("Generate() returned the same %q image for different hashes", style)
+			}
+
+			upper, err := generator.Generate(style, "205E460B479E2E5B48AEC07710C08D50", 80)
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+
+			if !bytes.Equal(first, upper) {
+				t.Errorf("Generate() returned different %q images for the same hash in another case", style)
+			}
+		})
+	}
+}
+
+func TestIsStyle(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		style string
+		want  bool
+	}{
+		{
+			name:  "Known style",
+			style: generator.StyleWavatar,
+			want:  true,
+		},
+		{
+			name:  "Legacy name",
+			style: "mysteryman",
+			want:  true,
+		},
+		{
+			name:  "Gravatar-only value",
+			style: "404",
+			want:  false,
+		},
+		{
+			name:  "Empty",
+			style: "",
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := generator.IsStyle(tt.style); got != tt.want {
+				t.Errorf("IsStyle(%q) = %v, want %v", tt.style, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package generator
+
+import "image/color"
+
+// _identiconPatches are the shapes an identicon is quilted from, defined on a
+// unit square.
+var _identiconPatches = [][]point{
+	{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+	{{0, 0}, {1, 0}, {0, 1}},
+	{{0.5, 0}, {1, 1}, {0, 1}},
+	{{0, 0}, {0.5, 0}, {0.5, 1}, {0, 1}},
+	{{0.5, 0}, {1, 0.5}, {0.5, 1}, {0, 0.5}},
+	{{0, 0}, {1, 0.5}, {1, 1}, {0.5, 1}},
+	{{0.25, 0.25}, {0.75, 0.25}, {0.75, 0.75}, {0.25, 0.75}},
+	{{0, 0}, {1, 0}, {0.5, 0.5}},
+	{{0, 0}, {0.5, 0}, {0, 0.5}},
+	{{0, 0.5}, {1, 0}, {1, 1}},
+	{{0, 0}, {0.5, 0.5}, {0, 1}},
+	{{0.5, 0}, {1, 0}, {1, 1}, {0, 1}},
+	{{0, 0}, {1, 0}, {1, 0.5}, {0, 0.5}},
+	{{0, 0}, {0.5, 0}, {1, 1}, {0.5, 1}},
+	{{0.5, 0.5}, {1, 0.5}, {1, 1}, {0.5, 1}},
+	{{0, 0}, {0.5, 0}, {0.5, 0.5}, {0, 0.5}},
+}
+
+// _identiconCenterPatches are the indexes of the symmetric patches that may
+// be used in the middle of an identicon.
+var _identiconCenterPatches = []int{0, 4, 6, 15}
+
+// renderIdenticon draws a 3×3 quilt of patches in the style of Don Park's
+// identicons: corners and sides use one patch each, rotated around the center
+// of the image.
+func renderIdenticon(c *canvas, s *seed) {
+	var (
+		foreground = hsl(s.hue(), 0.55, 0.55)
+		background = color.RGBA{R: 0xF0, G: 0xF0, B: 0xF0, A: 0xFF}
+		center     = _identiconPatches[_identiconCenterPatches[s.intn(len(_identiconCenterPatches))]]
+		corner     = _identiconPatches[s.intn(len(_identiconPatches))]
+		side       = _identiconPatches[s.intn(len(_identiconPatches))]
+		turn       = s.intn(4)
+		shapes     [][]point
+	)
+
+	c.fill(background)
+
+	shapes = append(shapes, identiconPatch(center, 1, 1, 0))
+
+	// Cells are listed clockwise from the top-left corner, so each one is a
+	// quarter turn away from the one two positions before it.
+	for i, cell := range [][2]int{{0, 0}, {1, 0}, {2, 0}, {2, 1}, {2, 2}, {1, 2}, {0, 2}, {0, 1}} {
+		patch := corner
+		if i%2 == 1 {
+			patch = side
+		}
+
+		shapes = append(shapes, identiconPatch(patch, cell[0], cell[1], turn+i/2))
+	}
+
+	c.polygons(foreground, shapes)
+}
+
+// identiconPatch returns the patch rotated by the given number of quarter
+// turns and moved to the given cell of the quilt, in canvas coordinates.
+func identiconPatch(patch []point, column, row, turns int) []point {
+	const (
+		margin = 0.08
+		cell   = (1 - 2*margin) / 3
+	)
+
+	points := make([]point, len(patch))
+
+	for i, p := range patch {
+		for j := 0; j < turns%4; j++ {
+			p = point{x: 1 - p.y, y: p.x}
+		}
+
+		points[i] = point{
+			x: margin + (float32(column)+p.x)*cell,
+			y: margin + (float32(row)+p.y)*cell,
+		}
+	}
+
+	return points
+}
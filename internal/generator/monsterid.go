@@ -0,0 +1,54 @@
+package generator
+
+import "image/color"
+
+// renderMonsterID draws a small monster with a randomly sized and colored body,
+// arms, legs, eyes, and mouth.
+func renderMonsterID(c *canvas, s *seed) {
+	var (
+		hue        = s.hue()
+		body       = hsl(hue, 0.5, 0.55)
+		limb       = hsl(hue, 0.5, 0.42)
+		background = color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+		white      = color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+		black      = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xFF}
+		width      = s.between(0.26, 0.36)
+		height     = s.between(0.24, 0.32)
+		arms       = s.between(0.35, 0.6)
+		eyes       = 1 + s.intn(3)
+		eyeSize    = s.between(0.05, 0.09)
+		mouth      = s.between(0.08, 0.2)
+	)
+
+	c.fill(background)
+
+	// Legs.
+	c.rect(limb, 0.5-width*0.6, 0.5, 0.08, 0.42)
+	c.rect(limb, 0.5+width*0.6-0.08, 0.5, 0.08, 0.42)
+
+	// Arms.
+	c.polygon(limb,
+		point{0.5 - width*0.8, 0.5},
+		point{0.08, arms},
+		point{0.08, arms + 0.08},
+		point{0.5 - width*0.8, 0.6},
+	)
+	c.polygon(limb,
+		point{0.5 + width*0.8, 0.5},
+		point{0.92, arms},
+		point{0.92, arms + 0.08},
+		point{0.5 + width*0.8, 0.6},
+	)
+
+	c.ellipse(body, 0.5, 0.5, width, height)
+
+	// Eyes are spread evenly across the upper half of the body.
+	for i := 0; i < eyes; i++ {
+		x := 0.5 - width*0.5 + width*float32(2*i+1)/float32(2*eyes)
+
+		c.ellipse(white, x, 0.5-height*0.35, eyeSize, eyeSize)
+		c.ellipse(black, x, 0.5-height*0.3, eyeSize*0.5, eyeSize*0.5)
+	}
+
+	c.rect(black, 0.5-mouth, 0.5+height*0.35, mouth*2, 0.04)
+}
@@ -0,0 +1,44 @@
+package generator
+
+import "image/color"
+
+// renderRetro draws an 8-bit arcade style face: a 5×5 grid of pixels mirrored
+// around its vertical axis.
+func renderRetro(c *canvas, s *seed) {
+	const (
+		cells  = 5
+		margin = 0.1
+		cell   = (1 - 2*margin) / cells
+	)
+
+	var (
+		foreground = hsl(s.hue(), 0.65, 0.5)
+		background = color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+		shapes     [][]point
+	)
+
+	c.fill(background)
+
+	for row := 0; row < cells; row++ {
+		for column := 0; column <= cells/2; column++ {
+			if s.next()&1 == 0 {
+				continue
+			}
+
+			y := margin + float32(row)*cell
+
+			shapes = append(shapes, square(margin+float32(column)*cell, y, cell))
+
+			if mirror := cells - 1 - column; mirror != column {
+				shapes = append(shapes, square(margin+float32(mirror)*cell, y, cell))
+			}
+		}
+	}
+
+	c.polygons(foreground, shapes)
+}
+
+// square returns a square with its top-left corner at (x, y).
+func square(x, y, size float32) []point {
+	return []point{{x, y}, {x + size, y}, {x + size, y + size}, {x, y + size}}
+}
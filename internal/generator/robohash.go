@@ -0,0 +1,60 @@
+package generator
+
+import "image/color"
+
+// renderRoboHash draws a robot head with a randomly chosen color, antenna,
+// eyes, and mouth.
+func renderRoboHash(c *canvas, s *seed) {
+	var (
+		hue        = s.hue()
+		metal      = hsl(hue, 0.35, 0.55)
+		dark       = hsl(hue, 0.35, 0.3)
+		light      = hsl(s.hue(), 0.9, 0.6)
+		background = color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+		width      = s.between(0.26, 0.34)
+		top        = s.between(0.24, 0.32)
+		round      = s.intn(2) == 0
+		teeth      = 3 + s.intn(4)
+	)
+
+	c.fill(background)
+
+	// Neck and antenna.
+	c.rect(dark, 0.42, 0.78, 0.16, 0.12)
+	c.rect(dark, 0.485, top-0.14, 0.03, 0.14)
+	c.ellipse(light, 0.5, top-0.14, 0.04, 0.04)
+
+	// Ears.
+	c.rect(dark, 0.5-width-0.06, 0.42, 0.06, 0.18)
+	c.rect(dark, 0.5+width, 0.42, 0.06, 0.18)
+
+	c.rect(metal, 0.5-width, top, width*2, 0.8-top)
+
+	// Eyes.
+	for _, x := range []float32{0.5 - width*0.5, 0.5 + width*0.5} {
+		if round {
+			c.ellipse(dark, x, 0.45, 0.075, 0.075)
+			c.ellipse(light, x, 0.45, 0.04, 0.04)
+
+			continue
+		}
+
+		c.rect(dark, x-0.08, 0.4, 0.16, 0.09)
+		c.rect(light, x-0.05, 0.42, 0.1, 0.05)
+	}
+
+	// Mouth.
+	var (
+		mouth  = width * 1.2
+		tooth  = mouth / float32(teeth)
+		shapes = make([][]point, 0, teeth)
+	)
+
+	c.rect(dark, 0.5-mouth/2, 0.62, mouth, 0.08)
+
+	for i := 0; i < teeth; i++ {
+		shapes = append(shapes, square(0.5-mouth/2+float32(i)*tooth+tooth*0.15, 0.635, tooth*0.7))
+	}
+
+	c.polygons(background, shapes)
+}
@@ -0,0 +1,40 @@
+package generator
+
+// renderWavatar draws a round face with randomly chosen colors, eyes, and
+// mouth on a colored background.
+func renderWavatar(c *canvas, s *seed) {
+	var (
+		hue        = s.hue()
+		background = hsl(hue, 0.45, 0.85)
+		face       = hsl(s.hue(), 0.6, 0.6)
+		feature    = hsl(hue, 0.3, 0.2)
+		white      = hsl(0, 0, 1)
+		eyeSize    = s.between(0.06, 0.1)
+		pupilSize  = eyeSize * s.between(0.35, 0.6)
+		eyeOffset  = s.between(0.1, 0.15)
+		mouth      = s.intn(3)
+	)
+
+	c.fill(background)
+	c.ellipse(face, 0.5, 0.52, 0.38, 0.38)
+
+	for _, x := range []float32{0.5 - eyeOffset, 0.5 + eyeOffset} {
+		c.ellipse(white, x, 0.44, eyeSize, eyeSize)
+		c.ellipse(feature, x, 0.45, pupilSize, pupilSize)
+	}
+
+	switch mouth {
+	case 0:
+		// Smile.
+		c.polygon(feature,
+			point{0.36, 0.62}, point{0.64, 0.62}, point{0.58, 0.7},
+			point{0.5, 0.72}, point{0.42, 0.7},
+		)
+	case 1:
+		// Surprise.
+		c.ellipse(feature, 0.5, 0.67, 0.05, 0.06)
+	default:
+		// Flat.
+		c.rect(feature, 0.4, 0.64, 0.2, 0.035)
+	}
+}
@@ -0,0 +1,149 @@
+// Package libravatar discovers federated Libravatar servers, which domains
+// advertise using DNS SRV records.
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/upstream"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+const (
+	// ErrInvalidDomain is returned when a domain isn't a valid domain name.
+	ErrInvalidDomain xerrors.Error = "invalid domain"
+
+	// ErrNoServer is returned when a domain doesn't advertise a Libravatar
+	// server.
+	ErrNoServer xerrors.Error = "no federated server for domain"
+
+	// ErrInvalidTarget is returned when the SRV record of a domain points to
+	// an invalid host.
+	ErrInvalidTarget xerrors.Error = "invalid SRV record target"
+)
+
+const (
+	// Service is the SRV service of Libravatar servers serving avatars over
+	// HTTPS. Servers only reachable over plain HTTP are ignored.
+	Service string = "avatars-sec"
+
+	// Proto is the SRV protocol of Libravatar servers.
+	Proto string = "tcp"
+)
+
+// _maxDomainLength is the maximum length of a domain name.
+const _maxDomainLength int = 253
+
+// _maxLabelLength is the maximum length of a label in a domain name.
+const _maxLabelLength int = 63
+
+// Resolver looks up DNS SRV records. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// Compile-time check to ensure net.Resolver implements the Resolver interface.
+var _ Resolver = (*net.Resolver)(nil)
+
+// Discovery finds the Libravatar server of a domain.
+type Discovery struct {
+	// resolver is used to look up SRV records.
+	resolver Resolver
+}
+
+// New returns a Discovery using the given resolver, or net.DefaultResolver if
+// it is nil.
+func New(resolver Resolver) *Discovery {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &Discovery{
+		resolver: resolver,
+	}
+}
+
+// Lookup returns the Libravatar server advertised by the domain as an upstream.
+// If the domain advertises more than one server, the first record with the
+// lowest priority is used, relying on the resolver to randomize records of the
+// same priority by weight.
+func (d *Discovery) Lookup(ctx context.Context, domain string) (*upstream.Upstream, error) {
+	if !IsDomain(domain) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDomain, domain)
+	}
+
+	_, records, err := d.resolver.LookupSRV(ctx, Service, Proto, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrNoServer, domain)
+		}
+
+		return nil, fmt.Errorf("failed to look up Libravatar server for %s: %w", domain, err)
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoServer, domain)
+	}
+
+	records = slices.Clone(records)
+
+	slices.SortStableFunc(records, func(a, b *net.SRV) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+
+	target := strings.TrimSuffix(records[0].Target, ".")
+
+	// A target of "." means the service is decidedly not available.
+	if target == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoServer, domain)
+	}
+
+	if !IsDomain(target) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTarget, records[0].Target)
+	}
+
+	host := strings.ToLower(target)
+	if records[0].Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(records[0].Port)))
+	}
+
+	server, err := upstream.New("libravatar:"+domain, "https://"+host+"/avatar/"+upstream.PlaceholderHash+"?"+upstream.PlaceholderQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTarget, err)
+	}
+
+	return server, nil
+}
+
+// IsDomain returns true if s is a syntactically valid domain name, without a
+// trailing dot.
+func IsDomain(s string) bool {
+	if s == "" || len(s) > _maxDomainLength {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > _maxLabelLength {
+			return false
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
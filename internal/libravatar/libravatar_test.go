@@ -0,0 +1,191 @@
+package libravatar_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/libravatar"
+)
+
+// fakeResolver is a DNS stand-in returning fixed SRV records.
+type fakeResolver struct {
+	records map[string][]*net.SRV
+	err     error
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if r.err != nil {
+		return "", nil, r.err
+	}
+
+	cname := "_" + service + "._" + proto + "." + name + "."
+
+	records, ok := r.records[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+
+	return cname, records, nil
+}
+
+func TestDiscovery_Lookup(t *testing.T) {
+	t.Parallel()
+
+	resolver := &fakeResolver{
+		records: map[string][]*net.SRV{
+			"example.org": {
+				{Target: "avatars.example.org.", Port: 443, Priority: 10},
+			},
+			"port.example.org": {
+				{Target: "avatars.example.org.", Port: 8443, Priority: 10},
+			},
+			"priority.example.org": {
+				{Target: "backup.example.org.", Port: 443, Priority: 20},
+				{Target: "primary.example.org.", Port: 443, Priority: 10},
+			},
+			"disabled.example.org": {
+				{Target: ".", Port: 0, Priority: 0},
+			},
+			"invalid.example.org": {
+				{Target: "evil.example.org/path?", Port: 443, Priority: 0},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		domain  string
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "Default port",
+			domain: "example.org",
+			want:   "https://avatars.example.org/avatar/abc?s=96",
+		},
+		{
+			name:   "Custom port",
+			domain: "port.example.org",
+			want:   "https://avatars.example.org:8443/avatar/abc?s=96",
+		},
+		{
+			name:   "Lowest priority first",
+			domain: "priority.example.org",
+			want:   "https://primary.example.org/avatar/abc?s=96",
+		},
+		{
+			name:    "No records",
+			domain:  "missing.example.org",
+			wantErr: libravatar.ErrNoServer,
+		},
+		{
+			name:    "Service disabled",
+			domain:  "disabled.example.org",
+			wantErr: libravatar.ErrNoServer,
+		},
+		{
+			name:    "Invalid target",
+			domain:  "invalid.example.org",
+			wantErr: libravatar.ErrInvalidTarget,
+		},
+		{
+			name:    "Invalid domain",
+			domain:  "example.org/avatar",
+			wantErr: libravatar.ErrInvalidDomain,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, err := libravatar.New(resolver).Lookup(context.Background(), tt.domain)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got := server.URL("abc", "s=96"); got != tt.want {
+				t.Errorf("Lookup() URL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscovery_Lookup_ResolverError(t *testing.T) {
+	t.Parallel()
+
+	var (
+		resolverErr = errors.New("server misbehaving")
+		resolver    = &fakeResolver{err: resolverErr}
+	)
+
+	_, err := libravatar.New(resolver).Lookup(context.Background(), "example.org")
+	if !errors.Is(err, resolverErr) {
+		t.Errorf("Lookup() error = %v, want %v", err, resolverErr)
+	}
+
+	if errors.Is(err, libravatar.ErrNoServer) {
+		t.Errorf("Lookup() error = %v, shouldn't be %v", err, libravatar.ErrNoServer)
+	}
+}
+
+func TestIsDomain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		give string
+		want bool
+	}{
+		{
+			name: "Domain",
+			give: "example.org",
+			want: true,
+		},
+		{
+			name: "Hyphenated label",
+			give: "my-example.org",
+			want: true,
+		},
+		{
+			name: "Empty",
+			give: "",
+		},
+		{
+			name: "Empty label",
+			give: "example..org",
+		},
+		{
+			name: "Leading hyphen",
+			give: "-example.org",
+		},
+		{
+			name: "Invalid character",
+			give: "exa_mple.org",
+		},
+		{
+			name: "Path",
+			give: "example.org/avatar",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := libravatar.IsDomain(tt.give); got != tt.want {
+				t.Errorf("IsDomain(%q) = %v, want %v", tt.give, got, tt.want)
+			}
+		})
+	}
+}
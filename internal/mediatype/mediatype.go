@@ -0,0 +1,124 @@
+// Package mediatype detects the media type of images, maps media types to
+// file extensions, and negotiates media types with clients.
+package mediatype
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// List of image media types known to the service.
+const (
+	JPEG string = "image/jpeg"
+	PNG  string = "image/png"
+	GIF  string = "image/gif"
+	WebP string = "image/webp"
+	AVIF string = "image/avif"
+)
+
+// Detect returns the media type of the given image based on its magic bytes,
+// or an empty string if it isn't a known image type.
+func Detect(data []byte) string {
+	// AVIF images are ISO BMFF files with an avif or avis brand, which
+	// http.DetectContentType doesn't know about.
+	if len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")) {
+		if brand := string(data[8:12]); brand == "avif" || brand == "avis" {
+			return AVIF
+		}
+	}
+
+	switch mediaType := http.DetectContentType(data); mediaType {
+	case JPEG, PNG, GIF, WebP:
+		return mediaType
+	default:
+		return ""
+	}
+}
+
+// Extension returns the file extension, including the leading dot, for the
+// given media type, or an empty string if the media type isn't known.
+func Extension(mediaType string) string {
+	switch mediaType {
+	case JPEG:
+		return ".jpg"
+	case PNG:
+		return ".png"
+	case GIF:
+		return ".gif"
+	case WebP:
+		return ".webp"
+	case AVIF:
+		return ".avif"
+	default:
+		return ""
+	}
+}
+
+// FromExtension returns the media type for the given file extension, including
+// the leading dot, or an empty string if the extension isn't known.
+func FromExtension(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return JPEG
+	case ".png":
+		return PNG
+	case ".gif":
+		return GIF
+	case ".webp":
+		return WebP
+	case ".avif":
+		return AVIF
+	default:
+		return ""
+	}
+}
+
+// Negotiate returns the offer preferred by the given Accept header, or an empty
+// string if none of the offers is acceptable. Ties are broken by the order of
+// the offers.
+//
+// Only media types listed explicitly are taken into account, since clients
+// send wildcards such as image/* regardless of the formats they support.
+func Negotiate(accept string, offers []string) string {
+	var (
+		best    string
+		bestQ   float64
+		accepts = strings.Split(accept, ",")
+	)
+
+	for _, offer := range offers {
+		if q := quality(accepts, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// quality returns the quality value given to a media type by the ranges of an
+// Accept header, or zero if it isn't listed.
+func quality(accepts []string, mediaType string) float64 {
+	for _, accept := range accepts {
+		acceptType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || acceptType != mediaType {
+			continue
+		}
+
+		value, ok := params["q"]
+		if !ok {
+			return 1
+		}
+
+		q, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0
+		}
+
+		return q
+	}
+
+	return 0
+}
@@ -0,0 +1,201 @@
+package mediatype_test
+
+import (
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/mediatype"
+)
+
+func TestDetect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		give []byte
+		want string
+	}{
+		{
+			name: "JPEG",
+			give: []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"),
+			want: mediatype.JPEG,
+		},
+		{
+			name: "PNG",
+			give: []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR"),
+			want: mediatype.PNG,
+		},
+		{
+			name: "GIF",
+			give: []byte("GIF89a\x01\x00\x01\x00"),
+			want: mediatype.GIF,
+		},
+		{
+			name: "WebP",
+			give: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+			want: mediatype.WebP,
+		},
+		{
+			name: "AVIF",
+			give: []byte("\x00\x00\x00\x1CftypavifMA1B"),
+			want: mediatype.AVIF,
+		},
+		{
+			name: "not an image",
+			give: []byte("<html><body>Not found</body></html>"),
+			want: "",
+		},
+		{
+			name: "empty",
+			give: nil,
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := mediatype.Detect(tt.give); got != tt.want {
+				t.Errorf("Detect() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		give string
+		want string
+	}{
+		{
+			name: "JPEG",
+			give: mediatype.JPEG,
+			want: ".jpg",
+		},
+		{
+			name: "PNG",
+			give: mediatype.PNG,
+			want: ".png",
+		},
+		{
+			name: "AVIF",
+			give: mediatype.AVIF,
+			want: ".avif",
+		},
+		{
+			name: "unknown",
+			give: "text/plain",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := mediatype.Extension(tt.give); got != tt.want {
+				t.Errorf("Extension() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromExtension(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		give string
+		want string
+	}{
+		{
+			name: "JPEG",
+			give: ".jpeg",
+			want: mediatype.JPEG,
+		},
+		{
+			name: "uppercase",
+			give: ".WEBP",
+			want: mediatype.WebP,
+		},
+		{
+			name: "unknown",
+			give: ".txt",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := mediatype.FromExtension(tt.give); got != tt.want {
+				t.Errorf("FromExtension() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	offers := []string{mediatype.AVIF, mediatype.WebP}
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{
+			name:   "modern browser",
+			accept: "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8",
+			want:   mediatype.AVIF,
+		},
+		{
+			name:   "WebP only",
+			accept: "image/webp,*/*",
+			want:   mediatype.WebP,
+		},
+		{
+			name:   "higher quality wins",
+			accept: "image/avif;q=0.5, image/webp;q=0.9",
+			want:   mediatype.WebP,
+		},
+		{
+			name:   "refused",
+			accept: "image/avif;q=0, image/webp;q=0",
+			want:   "",
+		},
+		{
+			name:   "wildcards only",
+			accept: "image/*,*/*;q=0.8",
+			want:   "",
+		},
+		{
+			name:   "empty",
+			accept: "",
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := mediatype.Negotiate(tt.accept, offers); got != tt.want {
+				t.Errorf("Negotiate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrInvalidRootCA is returned when the root certificate authority used to
+// verify the ACME directory can't be loaded.
+const ErrInvalidRootCA xerrors.Error = "failed to load ACME root certificate authority"
+
+// newACMEManager returns the manager obtaining and renewing the server's
+// certificates through ACME, or nil if ACME is disabled.
+func newACMEManager(cfg *config.Server) (*autocert.Manager, error) {
+	if cfg.Listener != config.ListenerTLS || cfg.ACME == nil {
+		return nil, nil //nolint:nilnil // ACME is disabled
+	}
+
+	httpClient, err := newACMEHTTPClient(cfg.ACME)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACME.CacheDirectory),
+		HostPolicy: autocert.HostWhitelist(cfg.ACME.Domains...),
+		Email:      cfg.ACME.Email,
+		Client: &acme.Client{
+			DirectoryURL: cfg.ACME.Directory,
+			HTTPClient:   httpClient,
+		},
+	}
+
+	return manager, nil
+}
+
+// newACMEHTTPClient returns the HTTP client used to talk to the ACME
+// directory, trusting the configured root certificate authority if any.
+func newACMEHTTPClient(cfg *config.ACME) (*http.Client, error) {
+	if cfg.RootCA == "" {
+		return http.DefaultClient, nil
+	}
+
+	data, err := os.ReadFile(cfg.RootCA)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRootCA, err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: no certificates found in %s", ErrInvalidRootCA, cfg.RootCA)
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		transport = &http.Transport{}
+	}
+
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Minute,
+	}, nil
+}
+
+// newACMEHTTPServer returns the server answering ACME HTTP-01 challenges and
+// redirecting other requests to HTTPS, or nil if HTTP-01 challenges are
+// disabled.
+func newACMEHTTPServer(cfg *config.Server, manager *autocert.Manager, logger *slog.Logger) *http.Server {
+	if manager == nil || cfg.ACME.HTTPAddress == "" {
+		return nil
+	}
+
+	return &http.Server{
+		Addr:         cfg.ACME.HTTPAddress,
+		Handler:      manager.HTTPHandler(nil),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+}
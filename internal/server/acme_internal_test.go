@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"golang.org/x/crypto/acme"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	t.Parallel()
+
+	invalidRootCA := filepath.Join(t.TempDir(), "root.pem")
+	if err := os.WriteFile(invalidRootCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		cfg         *config.Server
+		wantManager bool
+		wantHTTP    bool
+		wantErr     error
+	}{
+		{
+			name: "ACME disabled",
+			cfg: &config.Server{
+				Listener: config.ListenerTLS,
+				TLS:      &config.TLS{Version: "1.3"},
+			},
+		},
+		{
+			name: "TLS-ALPN-01 only",
+			cfg: &config.Server{
+				Listener: config.ListenerTLS,
+				TLS:      &config.TLS{Version: "1.3"},
+				ACME: &config.ACME{
+					Domains:        []string{"avatars.example.com"},
+					Directory:      "https://acme.example.com/dir",
+					CacheDirectory: t.TempDir(),
+				},
+			},
+			wantManager: true,
+		},
+		{
+			name: "HTTP-01 enabled",
+			cfg: &config.Server{
+				Listener: config.ListenerTLS,
+				TLS:      &config.TLS{Version: "1.2"},
+				ACME: &config.ACME{
+					Domains:        []string{"avatars.example.com"},
+					Directory:      "https://acme.example.com/dir",
+					CacheDirectory: t.TempDir(),
+					HTTPAddress:    ":80",
+				},
+			},
+			wantManager: true,
+			wantHTTP:    true,
+		},
+		{
+			name: "Invalid root CA",
+			cfg: &config.Server{
+				Listener: config.ListenerTLS,
+				TLS:      &config.TLS{Version: "1.3"},
+				ACME: &config.ACME{
+					Domains:        []string{"avatars.example.com"},
+					Directory:      "https://localhost:14000/dir",
+					RootCA:         invalidRootCA,
+					CacheDirectory: t.TempDir(),
+				},
+			},
+			wantErr: ErrInvalidRootCA,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			manager, err := newACMEManager(tt.cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newACMEManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if (manager != nil) != tt.wantManager {
+				t.Fatalf("newACMEManager() = %v, want manager %t", manager, tt.wantManager)
+			}
+
+			if manager == nil {
+				return
+			}
+
+			tlsConfig := newTLSConfig(tt.cfg, nil, manager)
+			if !slices.Contains(tlsConfig.NextProtos, acme.ALPNProto) {
+				t.Errorf("newTLSConfig() NextProtos = %v, want %q", tlsConfig.NextProtos, acme.ALPNProto)
+			}
+
+			httpServer := newACMEHTTPServer(tt.cfg, manager, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if (httpServer != nil) != tt.wantHTTP {
+				t.Errorf("newACMEHTTPServer() = %v, want server %t", httpServer, tt.wantHTTP)
+			}
+		})
+	}
+}
@@ -1,14 +1,31 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/endpoint"
 	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+	"git.sr.ht/~jamesponddotco/privytar/internal/flight"
+	"git.sr.ht/~jamesponddotco/privytar/internal/generator"
+	"git.sr.ht/~jamesponddotco/privytar/internal/libravatar"
+	"git.sr.ht/~jamesponddotco/privytar/internal/mediatype"
+	"git.sr.ht/~jamesponddotco/privytar/internal/upstream"
 	"git.sr.ht/~jamesponddotco/xstd-go/xhash/xfnv"
 	"git.sr.ht/~jamesponddotco/xstd-go/xnet/xhttp"
 )
@@ -19,37 +36,245 @@ const (
 
 	// HashSizeSHA256 is the size of the SHA256 hash.
 	HashSizeSHA256 int = 64
+
+	// FetchTimeout is the default maximum amount of time spent fetching an
+	// image from upstream, retries included, independent of the requests
+	// waiting for it. It is kept below the server's write timeout, so the
+	// error answered when upstream is too slow still reaches the client.
+	FetchTimeout time.Duration = 8 * time.Second
+
+	// DefaultSize is the size of avatars when the request doesn't set one,
+	// matching Gravatar's.
+	DefaultSize int = 80
+
+	// DefaultRetryAfter is how long clients are asked to wait when upstream
+	// rate limits the service without saying for how long.
+	DefaultRetryAfter time.Duration = time.Minute
+
+	// StatusClientClosedRequest is the non-standard status code logged when
+	// the client goes away before the avatar is fetched, as popularized by
+	// NGINX.
+	StatusClientClosedRequest int = 499
 )
 
+// CacheControl defines the caching headers sent along with avatars.
+type CacheControl struct {
+	// MaxAge is how long freshly fetched avatars may be cached. Avatars served
+	// from the cache use their remaining lifetime instead.
+	MaxAge time.Duration
+
+	// NotFoundMaxAge is how long the 404 answered for hashes without an avatar
+	// may be cached.
+	NotFoundMaxAge time.Duration
+
+	// SharedMaxAge is the s-maxage sent to shared caches. Zero omits it.
+	SharedMaxAge time.Duration
+
+	// Immutable defines whether avatars are marked as immutable.
+	Immutable bool
+}
+
+// CustomDefaults defines which custom default images, given as a URL in the d
+// parameter, are fetched on behalf of users.
+type CustomDefaults struct {
+	// Hosts is the list of hosts custom default images may be fetched from. A
+	// host starting with a dot also matches its subdomains. Empty disables
+	// custom default images.
+	Hosts []string
+
+	// MaxBytes is the maximum size in bytes of a custom default image.
+	MaxBytes int64
+}
+
+// Allows returns true if the custom default image at the given URL may be
+// fetched. Only HTTP and HTTPS URLs on the default port of an allowed host are
+// accepted. A nil CustomDefaults allows nothing.
+func (c *CustomDefaults) Allows(uri string) bool {
+	if c == nil {
+		return false
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.User != nil || parsed.Port() != "" {
+		return false
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+
+	for _, allowed := range c.Hosts {
+		allowed = strings.ToLower(allowed)
+
+		if host == strings.TrimPrefix(allowed, ".") {
+			return true
+		}
+
+		if strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Federation defines how avatars are fetched from the federated Libravatar
+// server of the domain given in the domain parameter.
+type Federation struct {
+	// Discovery finds the Libravatar server of a domain.
+	Discovery *libravatar.Discovery
+
+	// MaxBytes is the maximum size in bytes of an avatar fetched from a
+	// federated server.
+	MaxBytes int64
+}
+
+// Settings defines the settings of an AvatarHandler that can be changed while
+// it serves requests.
+type Settings struct {
+	// CacheControl defines the caching headers sent along with avatars.
+	CacheControl *CacheControl
+
+	// CustomDefaults defines which custom default images are fetched.
+	CustomDefaults *CustomDefaults
+
+	// Federation defines how avatars are fetched from federated Libravatar
+	// servers. Nil disables federation.
+	Federation *Federation
+
+	// Homepage is the URL requests without a hash are redirected to.
+	Homepage string
+
+	// BaseURL is the public URL of the service, used to build the canonical
+	// link sent along with avatars. Empty omits the link.
+	BaseURL string
+
+	// Upstreams are the avatar providers, tried in order.
+	Upstreams []*upstream.Upstream
+
+	// Now returns the current time, used to date avatars and their caching
+	// headers. It should match the cache's clock. Nil uses time.Now.
+	Now func() time.Time
+
+	// FetchTimeout is the maximum amount of time spent fetching an image from
+	// upstream. Zero uses FetchTimeout.
+	FetchTimeout time.Duration
+}
+
 // AvatarHandler is the HTTP handler for the /avatar endpoint.
 type AvatarHandler struct {
 	fetchClient *fetch.Client
-	cache       *cache.Cache
+	cache       cache.Backend
 	logger      *slog.Logger
-	homepage    string
+	flight      *flight.Group[*cache.Item]
+	settings    atomic.Pointer[Settings]
+
+	// generating limits how many default images are generated at once, since
+	// generating them is bound by the CPU.
+	generating chan struct{}
+
+	masterSize int
 }
 
-// NewAvatarHandler returns a new AvatarHandler instance.
+// NewAvatarHandler returns a new AvatarHandler instance. Avatars are fetched from
+// the first of the upstreams that has them, and avatars up to masterSize pixels
+// are resized from a single master image of that size per hash.
+//
+// Requests giving a domain try its federated Libravatar server before the
+// upstreams. A nil federation rejects them instead.
+//
+// Avatars are sent with a canonical link to their URL on the service, built
+// from baseURL, or without one if baseURL is empty.
 func NewAvatarHandler(
 	homepage string,
+	baseURL string,
+	masterSize int,
+	upstreams []*upstream.Upstream,
+	cacheControl *CacheControl,
+	customDefaults *CustomDefaults,
+	federation *Federation,
 	fetchClient *fetch.Client,
-	cacheInstance *cache.Cache,
+	cacheInstance cache.Backend,
 	logger *slog.Logger,
 ) *AvatarHandler {
-	return &AvatarHandler{
+	h := &AvatarHandler{
 		fetchClient: fetchClient,
 		cache:       cacheInstance,
 		logger:      logger,
-		homepage:    homepage,
+		flight:      &flight.Group[*cache.Item]{},
+		generating:  make(chan struct{}, runtime.GOMAXPROCS(0)),
+		masterSize:  masterSize,
+	}
+
+	h.Update(&Settings{
+		CacheControl:   cacheControl,
+		CustomDefaults: customDefaults,
+		Federation:     federation,
+		Homepage:       homepage,
+		BaseURL:        baseURL,
+		Upstreams:      upstreams,
+	})
+
+	return h
+}
+
+// Settings returns the current settings of the handler.
+func (h *AvatarHandler) Settings() *Settings {
+	return h.settings.Load()
+}
+
+// now returns the current time according to the handler's settings.
+func (h *AvatarHandler) now() time.Time {
+	if now := h.settings.Load().Now; now != nil {
+		return now()
+	}
+
+	return time.Now()
+}
+
+// fetchTimeout returns the maximum amount of time spent fetching an image
+// according to the handler's settings.
+func (h *AvatarHandler) fetchTimeout() time.Duration {
+	if timeout := h.settings.Load().FetchTimeout; timeout > 0 {
+		return timeout
 	}
+
+	return FetchTimeout
+}
+
+// Update replaces the settings of the handler. Requests being served when it
+// is called may finish with the previous settings.
+func (h *AvatarHandler) Update(settings *Settings) {
+	updated := *settings
+	updated.BaseURL = strings.TrimSuffix(updated.BaseURL, "/")
+
+	h.settings.Store(&updated)
 }
 
 // ServeHTTP handles HTTP requests for the /avatar endpoint.
 func (h *AvatarHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	hash := r.URL.Path[len("/avatar/"):]
+	settings := h.settings.Load()
+
+	// Accept the same path forms as Gravatar, with an optional trailing slash
+	// or file extension, so the service can replace it by swapping the host.
+	var (
+		hash      = strings.TrimSuffix(r.URL.Path[len("/avatar/"):], "/")
+		mediaType string
+	)
+
+	// An extension forces the format of the avatar, regardless of the Accept
+	// header.
+	if ext := path.Ext(hash); ext != "" {
+		if forced := mediatype.FromExtension(ext); fetch.CanTranscode(forced) {
+			hash = strings.TrimSuffix(hash, ext)
+			mediaType = forced
+		}
+	}
 
 	if hash == "" {
-		http.Redirect(w, r, h.homepage, http.StatusMovedPermanently)
+		http.Redirect(w, r, settings.Homepage, http.StatusMovedPermanently)
 
 		return
 	}
@@ -72,18 +297,18 @@ func (h *AvatarHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	normalizedQuery, err := NormalizeQueryString(r.URL.RawQuery)
+	req, err := newAvatarRequest(hash, mediaType, r.URL.RawQuery, h.masterSize)
 	if err != nil {
 		h.logger.LogAttrs(
 			r.Context(),
 			slog.LevelError,
-			"failed to normalize query string",
+			"invalid query string",
 			slog.String("query", r.URL.RawQuery),
 			slog.String("error", err.Error()),
 		)
 
 		response := xhttp.ResponseError{
-			Message: "Failed to normalize query string",
+			Message: "Invalid query string: " + err.Error(),
 			Code:    http.StatusBadRequest,
 		}
 
@@ -92,109 +317,804 @@ func (h *AvatarHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var (
-		uri      = fmt.Sprintf("https://secure.gravatar.com/avatar/%s?%s", hash, normalizedQuery)
-		cacheKey = xfnv.String(uri)
-	)
+	if req.fallback != nil && req.fallback.url != "" && !settings.CustomDefaults.Allows(req.fallback.url) {
+		h.logger.LogAttrs(
+			r.Context(),
+			slog.LevelError,
+			"custom default image not allowed",
+			slog.String("url", req.fallback.url),
+		)
 
-	image, err := h.cache.Get(cacheKey)
-	if err != nil {
-		if !errors.Is(err, cache.ErrKeyNotFound) && !errors.Is(err, cache.ErrKeyExpired) {
-			h.logger.LogAttrs(
-				r.Context(),
-				slog.LevelError,
-				"failed to get image from cache",
-				slog.String("cacheKey", cacheKey),
-				slog.String("error", err.Error()),
-			)
+		response := xhttp.ResponseError{
+			Message: "Custom default image not allowed",
+			Code:    http.StatusBadRequest,
+		}
 
-			response := xhttp.ResponseError{
-				Message: "Failed to get image from cache",
-				Code:    http.StatusInternalServerError,
-			}
+		response.Write(r.Context(), h.logger, w)
 
-			response.Write(r.Context(), h.logger, w)
+		return
+	}
 
-			return
+	if req.domain != "" && settings.Federation == nil {
+		h.logger.LogAttrs(
+			r.Context(),
+			slog.LevelError,
+			"libravatar federation disabled",
+			slog.String("domain", req.domain),
+		)
+
+		response := xhttp.ResponseError{
+			Message: "Libravatar federation is disabled",
+			Code:    http.StatusBadRequest,
 		}
 
-		// Image not found in cache. Fetch from Gravatar.com.
-		image, err = h.fetchClient.Remote(r.Context(), uri)
-		if err != nil {
+		response.Write(r.Context(), h.logger, w)
+
+		return
+	}
+
+	image, err := h.cache.Get(req.cacheKey)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, cache.ErrKeyStale):
+		// Serve the stale image right away and refresh it in the background.
+		go h.revalidate(r.Context(), req)
+	case errors.Is(err, cache.ErrKeyNotFound), errors.Is(err, cache.ErrKeyExpired):
+		// Image not found in cache or expired. Fetch from upstream, falling
+		// back to the expired image if there is one.
+		stale := image
+
+		image, err = h.fetch(r.Context(), req)
+		if err != nil && stale != nil {
 			h.logger.LogAttrs(
 				r.Context(),
-				slog.LevelError,
-				"failed to fetch image from Gravatar",
-				slog.String("url", uri),
+				slog.LevelWarn,
+				"failed to fetch image from upstream; serving stale image",
+				slog.String("hash", req.hash),
 				slog.String("error", err.Error()),
 			)
 
-			response := xhttp.ResponseError{
-				Message: "Failed to fetch image from Gravatar",
-				Code:    http.StatusBadGateway,
-			}
-
-			response.Write(r.Context(), h.logger, w)
+			image = stale
+		} else if err != nil {
+			h.writeFetchError(r.Context(), w, req, err)
 
 			return
 		}
+	default:
+		h.logger.LogAttrs(
+			r.Context(),
+			slog.LevelError,
+			"failed to get image from cache",
+			slog.String("cacheKey", req.cacheKey),
+			slog.String("error", err.Error()),
+		)
+
+		response := xhttp.ResponseError{
+			Message: "Failed to get image from cache",
+			Code:    http.StatusInternalServerError,
+		}
+
+		response.Write(r.Context(), h.logger, w)
+
+		return
+	}
+
+	if image.NotFound {
+		h.setCacheHeaders(w, image)
+
+		response := xhttp.ResponseError{
+			Message: "Avatar not found",
+			Code:    http.StatusNotFound,
+		}
+
+		response.Write(r.Context(), h.logger, w)
+
+		return
+	}
+
+	if req.mediaType == "" {
+		w.Header().Add("Vary", "Accept")
+
+		mediaType = mediatype.Negotiate(r.Header.Get("Accept"), fetch.TranscodeTargets)
+	}
+
+	image = h.transcode(r.Context(), req, image, mediaType)
+
+	contentType := image.ContentType
+	if contentType == "" {
+		contentType = mediatype.Detect(image.Value)
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline; filename="+req.hash+mediatype.Extension(contentType))
+	if settings.BaseURL != "" {
+		w.Header().Set("Link", "<"+canonicalURL(settings.BaseURL, req)+">; rel=\"canonical\"")
+	}
+
+	etag := image.ETag
+	if etag == "" {
+		etag = NewETag(image.Value)
+	}
+
+	w.Header().Set("ETag", etag)
+
+	h.setCacheHeaders(w, image)
+
+	// ServeContent answers If-None-Match and If-Modified-Since with a 304 Not
+	// Modified based on the ETag and modification time.
+	http.ServeContent(w, r, "", image.Modified, bytes.NewReader(image.Value))
+}
+
+// canonicalURL returns the URL of the requested avatar on the service at
+// baseURL, with the hash lowercased and the query string normalized, so every
+// equivalent request shares it. Upstream URLs are never used, since they would
+// point clients straight back at the upstream.
+func canonicalURL(baseURL string, req *avatarRequest) string {
+	uri := baseURL + endpoint.Avatar + strings.ToLower(req.hash) + mediatype.Extension(req.mediaType)
+
+	if req.normalizedQuery != "" {
+		uri += "?" + req.normalizedQuery
+	}
+
+	return uri
+}
+
+// writeFetchError answers a request whose image couldn't be fetched with the
+// status code matching the reason it failed.
+func (h *AvatarHandler) writeFetchError(ctx context.Context, w http.ResponseWriter, req *avatarRequest, err error) {
+	var (
+		rateLimit *fetch.RateLimitError
+		response  = xhttp.ResponseError{
+			Message: "Failed to fetch image from upstream",
+			Code:    http.StatusBadGateway,
+		}
+	)
+
+	switch {
+	case errors.Is(err, fetch.ErrCanceled), errors.Is(err, context.Canceled):
+		// The client is gone, so there is no one left to answer.
+		h.logger.LogAttrs(
+			ctx,
+			slog.LevelInfo,
+			"client closed request",
+			slog.String("hash", req.hash),
+			slog.Int("code", StatusClientClosedRequest),
+			slog.String("error", err.Error()),
+		)
+
+		return
+	case errors.Is(err, fetch.ErrNotFound):
+		response.Message = "Avatar not found"
+		response.Code = http.StatusNotFound
+	case errors.As(err, &rateLimit):
+		retryAfter := rateLimit.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = DefaultRetryAfter
+		}
+
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+
+		response.Message = "Upstream is rate limiting requests; try again later"
+		response.Code = http.StatusServiceUnavailable
+	case errors.Is(err, fetch.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		response.Message = "Timed out fetching image from upstream"
+		response.Code = http.StatusGatewayTimeout
+	case errors.Is(err, fetch.ErrDecodeImage), errors.Is(err, fetch.ErrNotImage):
+		response.Message = "Failed to decode image from upstream"
+	case errors.Is(err, fetch.ErrResizeImage):
+		response.Message = "Failed to resize image from upstream"
+	}
+
+	h.logger.LogAttrs(
+		ctx,
+		slog.LevelError,
+		"failed to fetch image from upstream",
+		slog.String("hash", req.hash),
+		slog.Int("code", response.Code),
+		slog.String("error", err.Error()),
+	)
+
+	response.Write(ctx, h.logger, w)
+}
+
+// fetch produces the requested image and saves it to the cache. Concurrent
+// requests for the same cache key share a single upstream request and
+// optimization pass.
+//
+// If the request has a fallback, it is used instead when no upstream has an
+// avatar for the hash, or right away if the request forces the default image.
+// Otherwise, the missing avatar is cached as a not found item, which is
+// returned without an error.
+//
+// The shared fetch isn't canceled when the request that started it is, since
+// other requests may be waiting for it, and failing to save the image to the
+// cache is logged without failing the requests.
+func (h *AvatarHandler) fetch(ctx context.Context, req *avatarRequest) (*cache.Item, error) {
+	item, _, err := h.flight.Do(ctx, req.cacheKey, func() (*cache.Item, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.fetchTimeout())
+		defer cancel()
+
+		return h.produce(fetchCtx, req, false)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return item, nil
+}
+
+// produce produces the requested image and saves it to the cache, as
+// described in fetch. When revalidating, a master image within the
+// stale-while-revalidate window is fetched from upstream again rather than
+// used.
+func (h *AvatarHandler) produce(ctx context.Context, req *avatarRequest, revalidating bool) (*cache.Item, error) {
+	var (
+		image  *fetch.Image
+		master *cache.Item
+		stale  bool
+		err    error
+	)
+
+	if req.fallback != nil && req.fallback.force {
+		image, err = h.defaultImage(ctx, req.fallback)
+	} else {
+		master, stale, err = h.fetchMaster(ctx, req, revalidating)
+		if err == nil {
+			image, err = h.derive(req, master)
+		}
+
+		switch {
+		case errors.Is(err, fetch.ErrNotFound) && req.fallback != nil:
+			image, err = h.defaultImage(ctx, req.fallback)
+		case errors.Is(err, fetch.ErrNotFound):
+			item := h.newNotFoundItem()
+
+			h.store(ctx, req.cacheKey, item)
+
+			return item, nil
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	item := h.newItem(image)
+
+	// An expired master image is only used because refreshing it failed,
+	// so the image derived from it is served with the master's age and
+	// isn't cached, leaving the next request to try upstream again.
+	if master != nil && !stale && !master.Expires.After(h.now()) {
+		item.Modified = master.Modified
+		item.Expires = master.Expires
+
+		return item, nil
+	}
+
+	h.store(ctx, req.cacheKey, item)
+
+	// An image derived from a stale master image is cached, so other
+	// requests don't derive it again, but served with the master's age and
+	// refreshed along with it in the background.
+	if stale {
+		item.Modified = master.Modified
+		item.Expires = master.Expires
+
+		go h.revalidate(ctx, req)
+	}
 
-		if err := h.cache.Set(cacheKey, image); err != nil {
+	return item, nil
+}
+
+// derive returns the requested size of an avatar, resized from its master
+// image. The master image is never served in its place, since it would be
+// cached as the requested size.
+func (h *AvatarHandler) derive(req *avatarRequest, master *cache.Item) (*fetch.Image, error) {
+	image, err := h.fetchClient.Resize(&fetch.Image{
+		ContentType: master.ContentType,
+		Data:        master.Value,
+	}, req.size)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return image, nil
+}
+
+// fetchMaster returns the master image of an avatar, fetching it from upstream
+// and saving it to the cache if it isn't fresh in the cache already. An
+// expired master image is used if fetching a fresh one fails.
+//
+// Unless revalidating, a master image within the stale-while-revalidate window
+// is returned right away along with true, leaving the caller to refresh it.
+//
+// Avatars no upstream has are cached as well, so every size of them is
+// answered with ErrNotFound without asking upstream again until they expire.
+//
+// Like in fetch, the shared fetch outlives the request that started it.
+func (h *AvatarHandler) fetchMaster(ctx context.Context, req *avatarRequest, revalidating bool) (*cache.Item, bool, error) {
+	item, err := h.cache.Get(req.masterKey)
+	if err == nil && item.NotFound {
+		return nil, false, fmt.Errorf("%w: no upstream has the avatar", fetch.ErrNotFound)
+	}
+
+	if err == nil {
+		return item, false, nil
+	}
+
+	if errors.Is(err, cache.ErrKeyStale) && !item.NotFound && !revalidating {
+		return item, true, nil
+	}
+
+	stale := item
+
+	item, _, err = h.flight.Do(ctx, req.masterKey, func() (*cache.Item, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.fetchTimeout())
+		defer cancel()
+
+		image, err := h.fetchUpstream(fetchCtx, req)
+		if errors.Is(err, fetch.ErrNotFound) {
+			h.store(fetchCtx, req.masterKey, h.newNotFoundItem())
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+
+		item := h.newItem(image)
+
+		h.store(fetchCtx, req.masterKey, item)
+
+		return item, nil
+	})
+	if err != nil && stale != nil && !errors.Is(err, fetch.ErrNotFound) {
+		h.logger.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"failed to fetch master image from upstream; using stale image",
+			slog.String("hash", req.hash),
+			slog.String("error", err.Error()),
+		)
+
+		return stale, false, nil
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("%w", err)
+	}
+
+	return item, false, nil
+}
+
+// fetchUpstream fetches the master image of an avatar from the first upstream
+// that has it, trying them in order, after the federated Libravatar server of
+// the request's domain if there is one. ErrNotFound is only returned if every
+// server reports that the avatar doesn't exist.
+func (h *AvatarHandler) fetchUpstream(ctx context.Context, req *avatarRequest) (*fetch.Image, error) {
+	var (
+		settings = h.settings.Load()
+		failures []error
+	)
+
+	if req.domain != "" && settings.Federation != nil {
+		image, err := h.fetchFederated(ctx, settings.Federation, req)
+
+		switch {
+		case err == nil:
+			h.logOptimization(ctx, req.domain, image)
+
+			return image, nil
+		case errors.Is(err, libravatar.ErrNoServer), errors.Is(err, fetch.ErrNotFound):
+		default:
 			h.logger.LogAttrs(
-				r.Context(),
-				slog.LevelError,
-				"failed to save image to cache",
-				slog.String("cacheKey", cacheKey),
+				ctx,
+				slog.LevelWarn,
+				"failed to fetch image from federated server; trying upstreams",
+				slog.String("domain", req.domain),
 				slog.String("error", err.Error()),
 			)
 
-			response := xhttp.ResponseError{
-				Message: "Failed to save image to cache",
-				Code:    http.StatusInternalServerError,
-			}
+			failures = append(failures, fmt.Errorf("%s: %w", req.domain, err))
+		}
+	}
 
-			response.Write(r.Context(), h.logger, w)
+	for _, u := range settings.Upstreams {
+		uri := u.URL(req.hash, req.masterQuery)
 
-			return
+		image, err := h.fetchClient.Remote(ctx, uri)
+		if err == nil {
+			h.logOptimization(ctx, u.Name, image)
+
+			return image, nil
 		}
-	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Content-Disposition", "inline, filename="+hash+".jpg")
-	w.Header().Set("Link", "<"+uri+">; rel=\"canonical\"")
+		if errors.Is(err, fetch.ErrNotFound) {
+			continue
+		}
 
-	if _, err := w.Write(image); err != nil {
 		h.logger.LogAttrs(
-			r.Context(),
-			slog.LevelError,
-			"failed to write response",
+			ctx,
+			slog.LevelWarn,
+			"failed to fetch image from upstream; trying the next one",
+			slog.String("upstream", u.Name),
 			slog.String("url", uri),
 			slog.String("error", err.Error()),
 		)
+
+		failures = append(failures, fmt.Errorf("%s: %w", u.Name, err))
+	}
+
+	if len(failures) > 0 {
+		return nil, errors.Join(failures...)
 	}
+
+	return nil, fmt.Errorf("%w: no upstream has the avatar", fetch.ErrNotFound)
 }
 
-// IsHexadecimal returns true if the string is a hexadecimal string.
-func IsHexadecimal(s string) bool {
-	for _, c := range s {
-		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
-			return false
+// fetchFederated fetches the master image of an avatar from the federated
+// Libravatar server of the request's domain. The server is chosen by whoever
+// controls the domain's DNS, so it is fetched like any other untrusted URL.
+func (h *AvatarHandler) fetchFederated(ctx context.Context, federation *Federation, req *avatarRequest) (*fetch.Image, error) {
+	server, err := federation.Discovery.Lookup(ctx, req.domain)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	image, err := h.fetchClient.Untrusted(ctx, server.URL(req.hash, req.masterQuery), federation.MaxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return image, nil
+}
+
+// logOptimization logs whether the optimized version of an image fetched from
+// the given source was picked over the original, along with both sizes.
+func (h *AvatarHandler) logOptimization(ctx context.Context, source string, image *fetch.Image) {
+	if image.Optimization == nil {
+		return
+	}
+
+	h.logger.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"fetched image from upstream",
+		slog.String("upstream", source),
+		slog.Bool("optimized", image.Optimization.Optimized),
+		slog.Int("originalBytes", image.Optimization.OriginalBytes),
+		slog.Int("optimizedBytes", image.Optimization.OptimizedBytes),
+	)
+}
+
+// defaultImage returns the default image for a hash without an avatar, either
+// generating it or fetching the custom one.
+func (h *AvatarHandler) defaultImage(ctx context.Context, fallback *defaultImage) (*fetch.Image, error) {
+	if fallback.url == "" {
+		return h.generate(ctx, fallback)
+	}
+
+	item, err := h.fetchCustomDefault(ctx, fallback.url)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return &fetch.Image{
+		ContentType: item.ContentType,
+		Data:        item.Value,
+	}, nil
+}
+
+// generate renders a built-in default image, waiting for its turn if as many
+// images as there are CPUs are being generated already.
+func (h *AvatarHandler) generate(ctx context.Context, fallback *defaultImage) (*fetch.Image, error) {
+	select {
+	case h.generating <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w", ctx.Err())
+	}
+
+	defer func() { <-h.generating }()
+
+	return fallback.generate()
+}
+
+// fetchCustomDefault fetches a custom default image and saves it to the cache.
+// Custom default images are cached under their own key, so they are fetched
+// once no matter how many hashes use them, and the shared fetch outlives the
+// request that started it.
+func (h *AvatarHandler) fetchCustomDefault(ctx context.Context, uri string) (*cache.Item, error) {
+	cacheKey := xfnv.String("default:" + uri)
+
+	item, err := h.cache.Get(cacheKey)
+	if err == nil || errors.Is(err, cache.ErrKeyStale) {
+		return item, nil
+	}
+
+	item, _, err = h.flight.Do(ctx, cacheKey, func() (*cache.Item, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.fetchTimeout())
+		defer cancel()
+
+		image, err := h.fetchClient.Untrusted(fetchCtx, uri, h.settings.Load().CustomDefaults.MaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
 		}
+
+		item := h.newItem(image)
+
+		h.store(fetchCtx, cacheKey, item)
+
+		return item, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
 	}
 
-	return true
+	return item, nil
 }
 
-// NormalizeQueryString returns a normalized query string.
-func NormalizeQueryString(query string) (string, error) {
-	if query == "" {
-		return "", nil
+// transcode returns the image converted to the given media type, saving the
+// result to the cache under a key specific to the media type. The image itself
+// is returned if no media type is given or it can't be converted.
+//
+// A media type forced by the request's extension is always used, while a
+// negotiated one is only used if the converted image is smaller, so they are
+// cached under different keys.
+//
+// Variants are cached under the ETag of the image they are converted from, so
+// a stale or expired image is only converted once and a refreshed one gets new
+// variants. They are served with the age of the image, whatever their own.
+func (h *AvatarHandler) transcode(ctx context.Context, req *avatarRequest, item *cache.Item, mediaType string) *cache.Item {
+	if mediaType == "" || item.ContentType == mediaType {
+		return item
 	}
 
-	parsedQuery, err := url.ParseQuery(query)
+	var (
+		convert = h.fetchClient.Transcode
+		prefix  = "variant:"
+	)
+
+	if req.mediaType != "" {
+		convert = h.fetchClient.Convert
+		prefix = "forced:"
+	}
+
+	cacheKey := xfnv.String(prefix + mediaType + ":" + req.cacheKey + ":" + item.ETag)
+
+	variant, err := h.cache.Get(cacheKey)
+	if err != nil && !errors.Is(err, cache.ErrKeyStale) {
+		variant, _, err = h.flight.Do(ctx, cacheKey, func() (*cache.Item, error) {
+			image, err := convert(&fetch.Image{
+				ContentType: item.ContentType,
+				Data:        item.Value,
+			}, mediaType)
+			if err != nil {
+				return nil, fmt.Errorf("%w", err)
+			}
+
+			variant := h.newItem(image)
+
+			h.store(ctx, cacheKey, variant)
+
+			return variant, nil
+		})
+	}
+
+	if err != nil && !errors.Is(err, cache.ErrKeyStale) {
+		h.logger.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"failed to transcode image; serving original format",
+			slog.String("mediaType", mediaType),
+			slog.String("error", err.Error()),
+		)
+
+		return item
+	}
+
+	aged := *variant
+	aged.Modified = item.Modified
+	aged.Expires = item.Expires
+
+	return &aged
+}
+
+// newItem returns a cache item for a freshly fetched image.
+func (h *AvatarHandler) newItem(image *fetch.Image) *cache.Item {
+	now := h.now()
+
+	return &cache.Item{
+		Modified:    now,
+		Expires:     now.Add(h.settings.Load().CacheControl.MaxAge),
+		ContentType: image.ContentType,
+		ETag:        NewETag(image.Data),
+		Value:       image.Data,
+	}
+}
+
+// newNotFoundItem returns a cache item recording that an avatar doesn't exist
+// upstream.
+func (h *AvatarHandler) newNotFoundItem() *cache.Item {
+	now := h.now()
+
+	return &cache.Item{
+		Modified: now,
+		Expires:  now.Add(h.settings.Load().CacheControl.NotFoundMaxAge),
+		NotFound: true,
+	}
+}
+
+// store saves an item to the cache. Failures are only logged, since the image
+// can still be served.
+func (h *AvatarHandler) store(ctx context.Context, cacheKey string, item *cache.Item) {
+	err := h.cache.Set(cacheKey, item)
+	if err == nil {
+		return
+	}
+
+	level := slog.LevelError
+
+	// Still serve the image, it just isn't worth evicting the rest of the
+	// cache for.
+	if errors.Is(err, cache.ErrEntryTooLarge) {
+		level = slog.LevelWarn
+	}
+
+	h.logger.LogAttrs(
+		ctx,
+		level,
+		"failed to save image to cache",
+		slog.String("cacheKey", cacheKey),
+		slog.Int("size", len(item.Value)),
+		slog.String("error", err.Error()),
+	)
+}
+
+// setCacheHeaders sets the Cache-Control and Expires headers for a cached
+// item based on the time it stops being fresh in the cache. Shared caches never
+// keep it longer than that, and only fresh images are marked as immutable.
+func (h *AvatarHandler) setCacheHeaders(w http.ResponseWriter, item *cache.Item) {
+	var (
+		cacheControl = h.settings.Load().CacheControl
+		now          = h.now()
+		maxAge       = item.Expires.Sub(now).Truncate(time.Second)
+	)
+
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	directives := []string{
+		"public",
+		"max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10),
+	}
+
+	if cacheControl.SharedMaxAge > 0 {
+		sharedMaxAge := min(cacheControl.SharedMaxAge, maxAge)
+
+		directives = append(directives, "s-maxage="+strconv.FormatInt(int64(sharedMaxAge.Seconds()), 10))
+	}
+
+	// Not found and stale responses are expected to change soon, so clients
+	// must be able to revalidate them.
+	if cacheControl.Immutable && !item.NotFound && maxAge > 0 {
+		directives = append(directives, "immutable")
+	}
+
+	w.Header().Set("Cache-Control", strings.Join(directives, ", "))
+	w.Header().Set("Expires", now.Add(maxAge).UTC().Format(http.TimeFormat))
+}
+
+// revalidate refreshes a stale image in the cache, along with the master image
+// it is derived from. It is meant to run in the background, outliving the
+// request that triggered it, and runs once at a time per image.
+func (h *AvatarHandler) revalidate(ctx context.Context, req *avatarRequest) {
+	bgCtx := context.WithoutCancel(ctx)
+
+	_, _, err := h.flight.Do(bgCtx, "revalidate:"+req.cacheKey, func() (*cache.Item, error) {
+		fetchCtx, cancel := context.WithTimeout(bgCtx, h.fetchTimeout())
+		defer cancel()
+
+		return h.produce(fetchCtx, req, true)
+	})
+	if err != nil {
+		h.logger.LogAttrs(
+			bgCtx,
+			slog.LevelWarn,
+			"failed to revalidate stale image",
+			slog.String("hash", req.hash),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// defaultImage describes the default image used for hashes without an
+// avatar, either a built-in style generated locally or a custom image fetched
+// from a URL.
+type defaultImage struct {
+	// hash is the hash the image is derived from.
+	hash string
+
+	// style is the generator style used to render the image.
+	style string
+
+	// url is the address of the custom default image. Empty for built-in
+	// styles.
+	url string
+
+	// size is the width and height of the image in pixels.
+	size int
+
+	// force defines whether the default image is used without asking
+	// upstream for the avatar.
+	force bool
+}
+
+// newDefaultImage returns the default image requested by a normalized query
+// and changes the query to ask upstreams to respond with a 404 rather than
+// render the default image itself.
+//
+// If the query doesn't request a built-in or custom default image, it returns
+// nil and leaves the query unchanged.
+func newDefaultImage(hash string, query url.Values, size int) *defaultImage {
+	var (
+		style  = query.Get("d")
+		custom = strings.HasPrefix(style, "http://") || strings.HasPrefix(style, "https://")
+	)
+
+	if !custom && !generator.IsStyle(style) {
+		return nil
+	}
+
+	query.Set("d", "404")
+
+	fallback := &defaultImage{
+		hash:  hash,
+		style: style,
+		size:  size,
+		force: query.Get("f") == "y",
+	}
+
+	if custom {
+		fallback.style = ""
+		fallback.url = style
+	}
+
+	return fallback
+}
+
+// generate renders the default image.
+func (d *defaultImage) generate() (*fetch.Image, error) {
+	data, err := generator.Generate(d.style, d.hash, d.size)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse query: %w", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
-	return parsedQuery.Encode(), nil
+	return &fetch.Image{
+		ContentType: generator.MediaType,
+		Data:        data,
+	}, nil
+}
+
+// NewETag returns a strong entity tag for the given image, derived from its
+// content.
+func NewETag(image []byte) string {
+	sum := sha256.Sum256(image)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// IsHexadecimal returns true if the string is a hexadecimal string.
+func IsHexadecimal(s string) bool {
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return false
+		}
+	}
+
+	return true
 }
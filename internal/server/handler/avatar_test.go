@@ -0,0 +1,1376 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+	"git.sr.ht/~jamesponddotco/privytar/internal/testutil"
+	"git.sr.ht/~jamesponddotco/privytar/internal/timeutil"
+	"git.sr.ht/~jamesponddotco/privytar/internal/upstream"
+)
+
+const _testHash = "205e460b479e2e5b48aec07710c08d50"
+
+func TestAvatarHandler_ServeHTTP_Upstreams(t *testing.T) {
+	t.Parallel()
+
+	var (
+		avatar = testPNG(t, 96)
+		found  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(avatar)
+		}))
+		missing = httptest.NewServer(http.NotFoundHandler())
+		corrupt = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("not an image"))
+		}))
+		truncated = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(avatar[:64])
+		}))
+		limited = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+	)
+
+	t.Cleanup(found.Close)
+	t.Cleanup(missing.Close)
+	t.Cleanup(corrupt.Close)
+	t.Cleanup(truncated.Close)
+	t.Cleanup(limited.Close)
+
+	tests := []struct {
+		name            string
+		upstreams       []string
+		query           string
+		wantStatus      int
+		wantContentType string
+	}{
+		{
+			name:            "First upstream has the avatar",
+			upstreams:       []string{found.URL + "/avatar/{hash}?{query}"},
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name: "Next upstream has the avatar",
+			upstreams: []string{
+				missing.URL + "/avatar/{hash}?{query}",
+				found.URL + "/avatar/{hash}?{query}",
+			},
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "No upstream has the avatar",
+			upstreams:       []string{missing.URL + "/avatar/{hash}?{query}"},
+			query:           "d=identicon",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "No upstream has the avatar and no default image",
+			upstreams:       []string{missing.URL + "/avatar/{hash}?{query}"},
+			query:           "d=404",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "Upstream returns an invalid image",
+			upstreams:       []string{corrupt.URL + "/avatar/{hash}?{query}"},
+			wantStatus:      http.StatusBadGateway,
+			wantContentType: "application/json",
+		},
+		{
+			// The master image is fetched, but the requested size can't be
+			// derived from it.
+			name:            "Upstream returns a truncated image",
+			upstreams:       []string{truncated.URL + "/avatar/{hash}?{query}"},
+			wantStatus:      http.StatusBadGateway,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "Upstream rate limits the service",
+			upstreams:       []string{limited.URL + "/avatar/{hash}?{query}"},
+			wantStatus:      http.StatusServiceUnavailable,
+			wantContentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := newTestHandler(t, &testHandlerConfig{
+				upstreams: tt.upstreams,
+			})
+
+			var (
+				req = httptest.NewRequest(http.MethodGet, "/avatar/"+_testHash+"?"+tt.query, http.NoBody)
+				rec = httptest.NewRecorder()
+			)
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+
+			if rec.Body.Len() == 0 {
+				t.Errorf("ServeHTTP() returned an empty body")
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			wantLink := "https://avatars.example.com/avatar/" + _testHash
+			if tt.query != "" {
+				wantLink += "?" + tt.query
+			}
+
+			if got := rec.Header().Get("Link"); got != "<"+wantLink+`>; rel="canonical"` {
+				t.Errorf("ServeHTTP() Link = %q, want canonical link to %q", got, wantLink)
+			}
+		})
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_Path(t *testing.T) {
+	t.Parallel()
+
+	avatar := testPNG(t, 96)
+
+	found := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(avatar)
+	}))
+
+	t.Cleanup(found.Close)
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams: []string{found.URL + "/avatar/{hash}?{query}"},
+	})
+
+	tests := []struct {
+		name            string
+		path            string
+		accept          string
+		wantStatus      int
+		wantContentType string
+		wantVary        string
+	}{
+		{
+			name:            "Hash",
+			path:            "/avatar/" + _testHash,
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+			wantVary:        "Accept",
+		},
+		{
+			name:            "Hash with a trailing slash",
+			path:            "/avatar/" + _testHash + "/",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+			wantVary:        "Accept",
+		},
+		{
+			name:            "PNG extension",
+			path:            "/avatar/" + _testHash + ".png",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "JPEG extension",
+			path:            "/avatar/" + _testHash + ".jpg",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/jpeg",
+		},
+		{
+			name:            "Uppercase JPEG extension",
+			path:            "/avatar/" + _testHash + ".JPG",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/jpeg",
+		},
+		{
+			name:            "Extension overrides the Accept header",
+			path:            "/avatar/" + _testHash + ".png",
+			accept:          "image/webp,image/*;q=0.8",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "Unknown extension",
+			path:            "/avatar/" + _testHash + ".bmp",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+		},
+		{
+			name:       "No hash",
+			path:       "/avatar/",
+			wantStatus: http.StatusMovedPermanently,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				req = httptest.NewRequest(http.MethodGet, tt.path, http.NoBody)
+				rec = httptest.NewRecorder()
+			)
+
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if tt.wantContentType == "" {
+				return
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if got := rec.Header().Get("Vary"); got != tt.wantVary {
+				t.Errorf("ServeHTTP() Vary = %q, want %q", got, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_Accept(t *testing.T) {
+	t.Parallel()
+
+	// Negotiated formats are only used when they are smaller, which they are
+	// for noisy images.
+	upstream := newTestUpstream(t, testNoisyPNG(t, 96))
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams: []string{upstream.template()},
+	})
+
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+	}{
+		{
+			name:            "WebP",
+			accept:          "image/webp,*/*",
+			wantContentType: "image/webp",
+		},
+		{
+			name:            "AVIF",
+			accept:          "image/avif,image/webp,image/apng,*/*;q=0.8",
+			wantContentType: "image/avif",
+		},
+		{
+			name:            "Higher quality value wins",
+			accept:          "image/avif;q=0.5,image/webp",
+			wantContentType: "image/webp",
+		},
+		{
+			name:            "PNG only",
+			accept:          "image/png",
+			wantContentType: "image/png",
+		},
+		{
+			name:            "Any media type",
+			accept:          "*/*",
+			wantContentType: "image/png",
+		},
+		{
+			name:            "No Accept header",
+			wantContentType: "image/png",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{}
+			if tt.accept != "" {
+				header.Set("Accept", tt.accept)
+			}
+
+			rec := serveAvatar(h, _testHash, header)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+
+			if got := rec.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("ServeHTTP() Vary = %q, want %q", got, "Accept")
+			}
+		})
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_Master(t *testing.T) {
+	t.Parallel()
+
+	upstream := newTestUpstream(t, testPNG(t, 512))
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams: []string{upstream.template()},
+	})
+
+	for _, size := range []int{80, 200} {
+		rec := serveAvatar(h, _testHash+"?s="+strconv.Itoa(size), nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+		}
+
+		config, err := png.DecodeConfig(rec.Body)
+		if err != nil {
+			t.Fatalf("ServeHTTP() returned an invalid PNG image: %v", err)
+		}
+
+		if config.Width != size || config.Height != size {
+			t.Errorf("ServeHTTP() image is %dx%d, want %dx%d", config.Width, config.Height, size, size)
+		}
+	}
+
+	// Both sizes are resized from the same master image.
+	if got := upstream.calls.Load(); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_HashCase(t *testing.T) {
+	t.Parallel()
+
+	upstream := newTestUpstream(t, testPNG(t, 96))
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams: []string{upstream.template()},
+	})
+
+	var etags []string
+
+	for _, hash := range []string{_testHash, strings.ToUpper(_testHash)} {
+		rec := serveAvatar(h, hash, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+		}
+
+		etags = append(etags, rec.Header().Get("ETag"))
+
+		want := "inline; filename=" + _testHash + ".png"
+		if got := rec.Header().Get("Content-Disposition"); got != want {
+			t.Errorf("ServeHTTP() Content-Disposition = %q, want %q", got, want)
+		}
+	}
+
+	if etags[0] != etags[1] {
+		t.Errorf("ServeHTTP() ETags = %q, want the same avatar for both cases", etags)
+	}
+
+	// The uppercase hash is answered from the cache entry of the lowercase
+	// one.
+	if got := upstream.calls.Load(); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_Conditional(t *testing.T) {
+	t.Parallel()
+
+	avatar := testPNG(t, 96)
+
+	found := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(avatar)
+	}))
+
+	t.Cleanup(found.Close)
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams: []string{found.URL + "/avatar/{hash}?{query}"},
+	})
+
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		var (
+			req = httptest.NewRequest(http.MethodGet, "/avatar/"+_testHash, http.NoBody)
+			rec = httptest.NewRecorder()
+		)
+
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		h.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	first := serve(nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d, want %d", first.Code, http.StatusOK)
+	}
+
+	var (
+		etag         = first.Header().Get("ETag")
+		lastModified = first.Header().Get("Last-Modified")
+	)
+
+	if etag == "" || lastModified == "" {
+		t.Fatalf("ServeHTTP() ETag = %q, Last-Modified = %q, want both set", etag, lastModified)
+	}
+
+	// The second request is answered from the cache.
+	if got := serve(nil).Header().Get("ETag"); got != etag {
+		t.Errorf("ServeHTTP() ETag = %q on a cache hit, want %q", got, etag)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{
+			name:   "If-None-Match",
+			header: http.Header{"If-None-Match": []string{etag}},
+		},
+		{
+			name:   "If-Modified-Since",
+			header: http.Header{"If-Modified-Since": []string{lastModified}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := serve(tt.header)
+
+			if rec.Code != http.StatusNotModified {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusNotModified)
+			}
+
+			if rec.Body.Len() != 0 {
+				t.Errorf("ServeHTTP() body = %d bytes, want empty", rec.Body.Len())
+			}
+
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ServeHTTP() ETag = %q, want %q", got, etag)
+			}
+		})
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_Stale(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Stale while revalidate", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			upstream = newTestUpstream(t, testPNG(t, 96))
+			clock    = testutil.NewClock()
+			h        = newTestHandler(t, &testHandlerConfig{
+				upstreams:            []string{upstream.template()},
+				clock:                clock,
+				staleWhileRevalidate: time.Hour,
+			})
+		)
+
+		first := serveAvatar(h, _testHash, nil)
+		if first.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() status = %d, want %d", first.Code, http.StatusOK)
+		}
+
+		etag := first.Header().Get("ETag")
+
+		clock.Advance(2 * time.Minute)
+
+		// The avatar changes upstream, but the stale one is served without
+		// waiting for it.
+		upstream.setAvatar(testPNG(t, 64))
+
+		rec := serveAvatar(h, _testHash, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+		}
+
+		if got := rec.Header().Get("ETag"); got != etag {
+			t.Fatalf("ServeHTTP() ETag = %q, want the stale %q", got, etag)
+		}
+
+		// The avatar is refreshed in the background, so wait for it.
+		deadline := time.Now().Add(5 * time.Second)
+
+		for serveAvatar(h, _testHash, nil).Header().Get("ETag") == etag {
+			if time.Now().After(deadline) {
+				t.Fatalf("ServeHTTP() kept serving the stale avatar after revalidating")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if got := upstream.calls.Load(); got < 2 {
+			t.Errorf("upstream calls = %d, want at least 2", got)
+		}
+	})
+
+	t.Run("Stale master", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			avatar  = testPNG(t, 96)
+			stalled atomic.Bool
+			release = make(chan struct{})
+			calls   atomic.Int32
+		)
+
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+
+			if stalled.Load() {
+				<-release
+			}
+
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(avatar)
+		}))
+
+		t.Cleanup(slow.Close)
+
+		// Unblock upstream before closing it, even if the test fails early.
+		unblock := sync.OnceFunc(func() { close(release) })
+		t.Cleanup(unblock)
+
+		var (
+			clock = testutil.NewClock()
+			h     = newTestHandler(t, &testHandlerConfig{
+				upstreams:            []string{slow.URL + "/avatar/{hash}?{query}"},
+				clock:                clock,
+				staleWhileRevalidate: time.Hour,
+			})
+		)
+
+		if rec := serveAvatar(h, _testHash+"?s=80", nil); rec.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+		}
+
+		clock.Advance(2 * time.Minute)
+		stalled.Store(true)
+
+		// Another size is derived from the stale master image without waiting
+		// for upstream, which is asked for a fresh one in the background.
+		done := make(chan *httptest.ResponseRecorder)
+
+		go func() {
+			done <- serveAvatar(h, _testHash+"?s=100", nil)
+		}()
+
+		select {
+		case rec := <-done:
+			if rec.Code != http.StatusOK {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			if got := cacheControlDirectives(rec.Header().Get("Cache-Control"))["max-age"]; got != "0" {
+				t.Errorf("ServeHTTP() max-age = %q, want 0 for an avatar derived from a stale image", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ServeHTTP() waited for upstream to derive from a stale master image")
+		}
+
+		unblock()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for calls.Load() < 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("ServeHTTP() never refreshed the stale master image")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("Stale if error", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			upstream = newTestUpstream(t, testPNG(t, 96))
+			clock    = testutil.NewClock()
+			h        = newTestHandler(t, &testHandlerConfig{
+				cacheControl: &handler.CacheControl{
+					MaxAge:         time.Minute,
+					NotFoundMaxAge: time.Minute,
+					Immutable:      true,
+				},
+				upstreams:    []string{upstream.template()},
+				clock:        clock,
+				staleIfError: time.Hour,
+			})
+		)
+
+		first := serveAvatar(h, _testHash, nil)
+		if first.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() status = %d, want %d", first.Code, http.StatusOK)
+		}
+
+		clock.Advance(2 * time.Minute)
+
+		upstream.setStatus(http.StatusForbidden)
+
+		// The avatar is derived again from the stale master image, but it is
+		// neither cached nor sent as fresh, so every request tries upstream.
+		for i := int32(2); i <= 3; i++ {
+			rec := serveAvatar(h, _testHash, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			if got, want := rec.Header().Get("ETag"), first.Header().Get("ETag"); got != want {
+				t.Errorf("ServeHTTP() ETag = %q, want the stale %q", got, want)
+			}
+
+			var (
+				header     = rec.Header().Get("Cache-Control")
+				directives = cacheControlDirectives(header)
+			)
+
+			if _, ok := directives["immutable"]; ok || directives["max-age"] != "0" {
+				t.Errorf("ServeHTTP() Cache-Control = %q, want max-age=0 without immutable", header)
+			}
+
+			if got := upstream.calls.Load(); got != i {
+				t.Errorf("upstream calls = %d, want %d", got, i)
+			}
+		}
+	})
+}
+
+func TestAvatarHandler_ServeHTTP_CustomDefault(t *testing.T) {
+	t.Parallel()
+
+	var (
+		missing = httptest.NewServer(http.NotFoundHandler())
+		custom  = newTestUpstream(t, testPNG(t, 64))
+
+		// toCustom sends every request to the custom default image server,
+		// whatever the host of the URL.
+		toCustom = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			r.URL.Host = custom.Listener.Addr().String()
+
+			return http.DefaultTransport.RoundTrip(r)
+		})
+	)
+
+	t.Cleanup(missing.Close)
+
+	tests := []struct {
+		name            string
+		uri             string
+		transport       http.RoundTripper
+		wantStatus      int
+		wantContentType string
+	}{
+		{
+			name:            "Allowed host",
+			uri:             "http://defaults.example.org/avatar.png",
+			transport:       toCustom,
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "Disallowed host",
+			uri:             "http://defaults.example.net/avatar.png",
+			transport:       toCustom,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "Private address",
+			uri:             "http://127.0.0.1/avatar.png",
+			wantStatus:      http.StatusBadGateway,
+			wantContentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := newTestHandler(t, &testHandlerConfig{
+				customDefaults: &handler.CustomDefaults{
+					Hosts:    []string{"defaults.example.org", "127.0.0.1"},
+					MaxBytes: 1 << 20,
+				},
+				upstreams:          []string{missing.URL + "/avatar/{hash}?{query}"},
+				untrustedTransport: tt.transport,
+			})
+
+			rec := serveAvatar(h, _testHash+"?d="+url.QueryEscape(tt.uri), nil)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+
+	// Only the allowed host is fetched, the private address being refused
+	// before connecting.
+	t.Cleanup(func() {
+		if got := custom.calls.Load(); got != 1 {
+			t.Errorf("custom default image server calls = %d, want 1", got)
+		}
+	})
+}
+
+func TestAvatarHandler_ServeHTTP_SlowUpstream(t *testing.T) {
+	t.Parallel()
+
+	const fetchTimeout = 100 * time.Millisecond
+
+	slow := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * fetchTimeout):
+		}
+	}))
+
+	t.Cleanup(slow.Close)
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams:    []string{slow.URL + "/avatar/{hash}?{query}"},
+		fetchTimeout: fetchTimeout,
+	})
+
+	// Serve the handler with a write timeout as close to the fetch timeout as
+	// the server's, so the test fails if the error is written after the
+	// connection is closed.
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.WriteTimeout = fetchTimeout + 200*time.Millisecond
+	srv.Start()
+
+	t.Cleanup(srv.Close)
+
+	resp, err := srv.Client().Get(srv.URL + "/avatar/" + _testHash)
+	if err != nil {
+		t.Fatalf("Get() error = %v, want a response", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Get() status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_LeaderCanceled(t *testing.T) {
+	t.Parallel()
+
+	var (
+		avatar  = testPNG(t, 96)
+		started = make(chan struct{})
+		release = make(chan struct{})
+		calls   atomic.Int32
+	)
+
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(avatar)
+	}))
+
+	t.Cleanup(blocking.Close)
+
+	h := newTestHandler(t, &testHandlerConfig{
+		upstreams: []string{blocking.URL + "/avatar/{hash}?{query}"},
+	})
+
+	// The first request starts fetching the master image and goes away while
+	// upstream is still answering.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	leader := make(chan struct{})
+
+	go func() {
+		defer close(leader)
+
+		req := httptest.NewRequest(http.MethodGet, "/avatar/"+_testHash+"?s=80", http.NoBody).WithContext(ctx)
+
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-started
+	cancel()
+	<-leader
+
+	// Another size shares the master image fetch the first request started,
+	// which must not have been canceled along with it.
+	done := make(chan *httptest.ResponseRecorder)
+
+	go func() {
+		done <- serveAvatar(h, _testHash+"?s=100", nil)
+	}()
+
+	close(release)
+
+	rec := <-done
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+}
+
+func TestAvatarHandler_ServeHTTP_CacheHeaders(t *testing.T) {
+	t.Parallel()
+
+	var (
+		avatar = testPNG(t, 96)
+		found  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(avatar)
+		}))
+		missing = httptest.NewServer(http.NotFoundHandler())
+	)
+
+	t.Cleanup(found.Close)
+	t.Cleanup(missing.Close)
+
+	tests := []struct {
+		name          string
+		upstream      string
+		query         string
+		expiration    time.Duration
+		stale         bool
+		wantStatus    int
+		wantMaxAge    int64
+		wantImmutable bool
+	}{
+		{
+			name:          "Fresh avatar",
+			upstream:      found.URL,
+			expiration:    time.Hour,
+			wantStatus:    http.StatusOK,
+			wantMaxAge:    3600,
+			wantImmutable: true,
+		},
+		{
+			name:       "Stale avatar",
+			upstream:   found.URL,
+			expiration: time.Minute,
+			stale:      true,
+			wantStatus: http.StatusOK,
+			wantMaxAge: 0,
+		},
+		{
+			name:       "Avatar not found",
+			upstream:   missing.URL,
+			query:      "d=404",
+			expiration: time.Hour,
+			wantStatus: http.StatusNotFound,
+			wantMaxAge: 60,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				clock = testutil.NewClock()
+				h     = newTestHandler(t, &testHandlerConfig{
+					cacheControl: &handler.CacheControl{
+						MaxAge:         tt.expiration,
+						NotFoundMaxAge: time.Minute,
+						SharedMaxAge:   24 * time.Hour,
+						Immutable:      true,
+					},
+					upstreams:            []string{tt.upstream + "/avatar/{hash}?{query}"},
+					clock:                clock,
+					expiration:           tt.expiration,
+					staleWhileRevalidate: time.Hour,
+				})
+			)
+
+			serve := func() *httptest.ResponseRecorder {
+				var (
+					req = httptest.NewRequest(http.MethodGet, "/avatar/"+_testHash+"?"+tt.query, http.NoBody)
+					rec = httptest.NewRecorder()
+				)
+
+				h.ServeHTTP(rec, req)
+
+				return rec
+			}
+
+			rec := serve()
+
+			if tt.stale {
+				clock.Advance(5 * tt.expiration)
+
+				rec = serve()
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			var (
+				header     = rec.Header().Get("Cache-Control")
+				directives = cacheControlDirectives(header)
+			)
+
+			if got := directives["max-age"]; got != strconv.FormatInt(tt.wantMaxAge, 10) {
+				t.Errorf("ServeHTTP() Cache-Control = %q, want max-age=%d", header, tt.wantMaxAge)
+			}
+
+			if got := directives["s-maxage"]; got != directives["max-age"] {
+				t.Errorf("ServeHTTP() Cache-Control = %q, want s-maxage capped at max-age", header)
+			}
+
+			if _, ok := directives["immutable"]; ok != tt.wantImmutable {
+				t.Errorf("ServeHTTP() Cache-Control = %q, want immutable = %t", header, tt.wantImmutable)
+			}
+		})
+	}
+}
+
+func TestCustomDefaults_Allows(t *testing.T) {
+	t.Parallel()
+
+	allowed := &handler.CustomDefaults{
+		Hosts: []string{"images.example.com", ".cdn.example.org"},
+	}
+
+	tests := []struct {
+		name     string
+		defaults *handler.CustomDefaults
+		uri      string
+		want     bool
+	}{
+		{
+			name:     "Allowed host",
+			defaults: allowed,
+			uri:      "https://images.example.com/default.png",
+			want:     true,
+		},
+		{
+			name:     "Allowed subdomain",
+			defaults: allowed,
+			uri:      "https://a.cdn.example.org/default.png",
+			want:     true,
+		},
+		{
+			name:     "Other host",
+			defaults: allowed,
+			uri:      "https://example.net/default.png",
+		},
+		{
+			name:     "Explicit port",
+			defaults: allowed,
+			uri:      "https://images.example.com:8443/default.png",
+		},
+		{
+			name:     "Nil custom defaults",
+			defaults: nil,
+			uri:      "https://images.example.com/default.png",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := tt.defaults.Allows(tt.uri); got != tt.want {
+				t.Errorf("Allows(%q) = %t, want %t", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvatarHandler_Update(t *testing.T) {
+	t.Parallel()
+
+	var (
+		avatar = testPNG(t, 96)
+		found  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(avatar)
+		}))
+		missing = httptest.NewServer(http.NotFoundHandler())
+	)
+
+	t.Cleanup(found.Close)
+	t.Cleanup(missing.Close)
+
+	newUpstream := func(template string) []*upstream.Upstream {
+		u, err := upstream.New("test", template)
+		if err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+
+		return []*upstream.Upstream{u}
+	}
+
+	h := handler.NewAvatarHandler(
+		"https://www.example.com",
+		"https://avatars.example.com",
+		512,
+		newUpstream(missing.URL+"/avatar/{hash}?{query}"),
+		&handler.CacheControl{MaxAge: time.Minute, NotFoundMaxAge: time.Minute},
+		&handler.CustomDefaults{},
+		nil,
+		fetch.New("TestService", "test@example.com", nil),
+		// s-maxage is capped at the remaining lifetime in the cache, so it
+		// must outlive the shared max age checked below.
+		cache.New(16, timeutil.CacheDuration{Duration: 2 * time.Hour}),
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+
+	serve := func(hash string) *httptest.ResponseRecorder {
+		var (
+			req = httptest.NewRequest(http.MethodGet, "/avatar/"+hash+"?d=404", http.NoBody)
+			rec = httptest.NewRecorder()
+		)
+
+		h.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := serve(_testHash); rec.Code != http.StatusNotFound {
+		t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	h.Update(&handler.Settings{
+		CacheControl:   &handler.CacheControl{MaxAge: 2 * time.Hour, NotFoundMaxAge: time.Minute, SharedMaxAge: time.Hour},
+		CustomDefaults: &handler.CustomDefaults{},
+		Homepage:       "https://www.example.com",
+		BaseURL:        "https://new.example.com/",
+		Upstreams:      newUpstream(found.URL + "/avatar/{hash}?{query}"),
+	})
+
+	// Another hash, since the first one is cached as not found.
+	hash := strings.Repeat("a", handler.HashSizeMD5)
+
+	rec := serve(hash)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	wantLink := "<https://new.example.com/avatar/" + hash + `?d=404>; rel="canonical"`
+	if got := rec.Header().Get("Link"); got != wantLink {
+		t.Errorf("ServeHTTP() Link = %q, want %q", got, wantLink)
+	}
+
+	if got := rec.Header().Get("Cache-Control"); !strings.Contains(got, "s-maxage=3600") {
+		t.Errorf("ServeHTTP() Cache-Control = %q, want s-maxage=3600", got)
+	}
+}
+
+// testHandlerConfig defines the handler returned by newTestHandler. Zero
+// fields use defaults suitable for most tests.
+type testHandlerConfig struct {
+	cacheControl   *handler.CacheControl
+	customDefaults *handler.CustomDefaults
+	upstreams      []string
+
+	// untrustedTransport replaces the transport used to fetch custom default
+	// images, skipping the address check.
+	untrustedTransport http.RoundTripper
+
+	// clock replaces the clock of both the handler and its cache.
+	clock *testutil.Clock
+
+	// expiration is how long avatars stay fresh in the cache, a minute if
+	// zero.
+	expiration time.Duration
+
+	// staleWhileRevalidate and staleIfError are how long stale avatars are
+	// served by the cache.
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	// fetchTimeout replaces the maximum amount of time spent fetching an
+	// image, if not zero.
+	fetchTimeout time.Duration
+}
+
+// newTestHandler returns an avatar handler fetching from the given upstream
+// URL templates.
+func newTestHandler(t *testing.T, cfg *testHandlerConfig) *handler.AvatarHandler {
+	t.Helper()
+
+	upstreams := make([]*upstream.Upstream, 0, len(cfg.upstreams))
+
+	for i, template := range cfg.upstreams {
+		u, err := upstream.New(string(rune('a'+i)), template)
+		if err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+
+		upstreams = append(upstreams, u)
+	}
+
+	if cfg.expiration == 0 {
+		cfg.expiration = time.Minute
+	}
+
+	var now func() time.Time
+
+	if cfg.clock != nil {
+		now = cfg.clock.Now
+	}
+
+	backend := cache.NewWithOptions(&cache.Options{
+		Capacity:             64,
+		Expiration:           timeutil.CacheDuration{Duration: cfg.expiration},
+		NotFoundExpiration:   timeutil.CacheDuration{Duration: time.Minute},
+		StaleWhileRevalidate: timeutil.CacheDuration{Duration: cfg.staleWhileRevalidate},
+		StaleIfError:         timeutil.CacheDuration{Duration: cfg.staleIfError},
+		Now:                  now,
+	})
+
+	if cfg.cacheControl == nil {
+		cfg.cacheControl = &handler.CacheControl{MaxAge: time.Minute, NotFoundMaxAge: time.Minute}
+	}
+
+	if cfg.customDefaults == nil {
+		cfg.customDefaults = &handler.CustomDefaults{}
+	}
+
+	// Requests are still limited and retried, but without waiting long.
+	fetchClient := fetch.New("TestService", "test@example.com", nil)
+	fetchClient.SetRateLimit(1000, 10)
+	fetchClient.SetRetryPolicy(fetch.MaxAttempts, time.Millisecond)
+
+	if cfg.untrustedTransport != nil {
+		fetchClient.SetUntrustedTransport(cfg.untrustedTransport)
+	}
+
+	h := handler.NewAvatarHandler(
+		"https://www.example.com",
+		"https://avatars.example.com",
+		512,
+		upstreams,
+		cfg.cacheControl,
+		cfg.customDefaults,
+		nil,
+		fetchClient,
+		backend,
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+
+	settings := *h.Settings()
+	settings.Now = now
+	settings.FetchTimeout = cfg.fetchTimeout
+
+	h.Update(&settings)
+
+	return h
+}
+
+// testUpstream is an upstream serving a single avatar, whose response can be
+// changed while a test runs.
+type testUpstream struct {
+	*httptest.Server
+
+	// avatar is the PNG image served for every hash.
+	avatar atomic.Pointer[[]byte]
+
+	// status is the status code answered instead of the avatar, if not zero.
+	status atomic.Int32
+
+	// calls is the number of requests received.
+	calls atomic.Int32
+}
+
+// newTestUpstream returns a running upstream serving the given avatar.
+func newTestUpstream(t *testing.T, avatar []byte) *testUpstream {
+	t.Helper()
+
+	u := &testUpstream{}
+	u.setAvatar(avatar)
+
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		u.calls.Add(1)
+
+		if status := u.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(*u.avatar.Load())
+	}))
+
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+// setAvatar changes the avatar served by the upstream.
+func (u *testUpstream) setAvatar(avatar []byte) {
+	u.avatar.Store(&avatar)
+}
+
+// setStatus makes the upstream answer every request with the given status
+// code.
+func (u *testUpstream) setStatus(status int) {
+	u.status.Store(int32(status))
+}
+
+// template returns the URL template of the upstream.
+func (u *testUpstream) template() string {
+	return u.URL + "/avatar/{hash}?{query}"
+}
+
+// serveAvatar requests the avatar for the given hash and query string from the
+// handler.
+func serveAvatar(h http.Handler, hashAndQuery string, header http.Header) *httptest.ResponseRecorder {
+	var (
+		req = httptest.NewRequest(http.MethodGet, "/avatar/"+hashAndQuery, http.NoBody)
+		rec = httptest.NewRecorder()
+	)
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// roundTripperFunc is an http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper.
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// cacheControlDirectives returns the directives of a Cache-Control header
+// mapped to their values.
+func cacheControlDirectives(header string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		directives[name] = value
+	}
+
+	return directives
+}
+
+// testPNG returns a square PNG image of the given size.
+func testPNG(t *testing.T, size int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xFF})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// testNoisyPNG returns a square PNG image of the given size filled with random
+// pixels, which lossy formats compress far better than PNG.
+func testNoisyPNG(t *testing.T, size int) []byte {
+	t.Helper()
+
+	var (
+		rng = rand.New(rand.NewSource(1)) //nolint:gosec // deterministic test data
+		img = image.NewRGBA(image.Rect(0, 0, size, size))
+	)
+
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: 0x80, A: 0xFF})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// StatusOK is the status of a check that passed.
+	StatusOK string = "ok"
+
+	// StatusUnavailable is the status of a check that failed.
+	StatusUnavailable string = "unavailable"
+
+	// CheckTimeout is the maximum amount of time a readiness check may run.
+	CheckTimeout time.Duration = 5 * time.Second
+)
+
+// Check is a readiness check of a part of the service.
+type Check struct {
+	// Run returns an error if the part of the service it checks isn't ready.
+	Run func(ctx context.Context) error
+
+	// Name identifies the check in the response.
+	Name string
+}
+
+// CachedCheck returns a check that runs at most once per ttl, reporting the
+// result of its last run in between, for checks too expensive to run on every
+// request such as probing upstreams.
+//
+// The check runs with its own timeout rather than the caller's context, so a
+// caller giving up doesn't abort it, and callers arriving while it runs get the
+// result of the previous run instead of waiting. Runs ending with a context
+// error aren't remembered, so the next caller runs the check again.
+func CachedCheck(name string, ttl time.Duration, run func(ctx context.Context) error) Check {
+	var (
+		mu      sync.Mutex
+		checked time.Time
+		result  error
+		current *checkRun
+	)
+
+	start := func(ctx context.Context) *checkRun {
+		r := &checkRun{done: make(chan struct{})}
+
+		go func() {
+			runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), CheckTimeout)
+			defer cancel()
+
+			r.err = run(runCtx)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !errors.Is(r.err, context.Canceled) && !errors.Is(r.err, context.DeadlineExceeded) {
+				checked = time.Now()
+				result = r.err
+			}
+
+			current = nil
+
+			close(r.done)
+		}()
+
+		return r
+	}
+
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) error {
+			mu.Lock()
+
+			if !checked.IsZero() && (current != nil || time.Since(checked) < ttl) {
+				defer mu.Unlock()
+
+				return result
+			}
+
+			if current == nil {
+				current = start(ctx)
+			}
+
+			r := current
+
+			mu.Unlock()
+
+			select {
+			case <-r.done:
+				return r.err
+			case <-ctx.Done():
+				return fmt.Errorf("%w", ctx.Err())
+			}
+		},
+	}
+}
+
+// checkRun is a run of a cached check.
+type checkRun struct {
+	// err is the result of the run, set before done is closed.
+	err error
+
+	// done is closed when the run finishes.
+	done chan struct{}
+}
+
+// CheckStatus is the result of a readiness check.
+type CheckStatus struct {
+	// Status is StatusOK if the check passed, or StatusUnavailable otherwise.
+	Status string `json:"status"`
+
+	// Error describes why the check failed.
+	Error string `json:"error,omitempty"`
+}
+
+// HealthResponse is the response of the health endpoints.
+type HealthResponse struct {
+	// Checks are the results of the readiness checks, by name.
+	Checks map[string]*CheckStatus `json:"checks,omitempty"`
+
+	// Status is StatusOK if the service is healthy, or StatusUnavailable
+	// otherwise.
+	Status string `json:"status"`
+}
+
+// HealthHandler is the HTTP handler for the /healthz endpoint, which reports
+// that the process is alive and answering requests.
+type HealthHandler struct {
+	logger *slog.Logger
+}
+
+// NewHealthHandler returns a new HealthHandler instance.
+func NewHealthHandler(logger *slog.Logger) *HealthHandler {
+	return &HealthHandler{
+		logger: logger,
+	}
+}
+
+// ServeHTTP handles HTTP requests for the /healthz endpoint.
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeHealth(r.Context(), h.logger, w, http.StatusOK, &HealthResponse{Status: StatusOK})
+}
+
+// ReadyHandler is the HTTP handler for the /readyz endpoint, which reports
+// whether the service is ready to serve avatars.
+type ReadyHandler struct {
+	logger *slog.Logger
+	checks []Check
+}
+
+// NewReadyHandler returns a new ReadyHandler instance. The service is ready
+// when every check passes.
+func NewReadyHandler(checks []Check, logger *slog.Logger) *ReadyHandler {
+	return &ReadyHandler{
+		logger: logger,
+		checks: checks,
+	}
+}
+
+// ServeHTTP handles HTTP requests for the /readyz endpoint, answering with a
+// 503 Service Unavailable if any check fails.
+func (h *ReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		code     = http.StatusOK
+		response = &HealthResponse{
+			Checks: make(map[string]*CheckStatus, len(h.checks)),
+			Status: StatusOK,
+		}
+	)
+
+	for _, check := range h.checks {
+		ctx, cancel := context.WithTimeout(r.Context(), CheckTimeout)
+		err := check.Run(ctx)
+
+		cancel()
+
+		if err == nil {
+			response.Checks[check.Name] = &CheckStatus{Status: StatusOK}
+
+			continue
+		}
+
+		h.logger.LogAttrs(
+			r.Context(),
+			slog.LevelWarn,
+			"readiness check failed",
+			slog.String("check", check.Name),
+			slog.String("error", err.Error()),
+		)
+
+		response.Checks[check.Name] = &CheckStatus{
+			Status: StatusUnavailable,
+			Error:  err.Error(),
+		}
+		response.Status = StatusUnavailable
+		code = http.StatusServiceUnavailable
+	}
+
+	writeHealth(r.Context(), h.logger, w, code, response)
+}
+
+// writeHealth writes the response of a health endpoint as JSON. Responses are
+// never cached, since they only describe the service at the time of the
+// request.
+func writeHealth(ctx context.Context, logger *slog.Logger, w http.ResponseWriter, code int, response *HealthResponse) {
+	js, err := json.Marshal(response)
+	if err != nil {
+		logger.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"failed to encode health response",
+			slog.String("error", err.Error()),
+		)
+
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	_, _ = w.Write(js)
+}
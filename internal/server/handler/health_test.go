@@ -0,0 +1,262 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+)
+
+func TestHealthHandler_ServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	var (
+		h   = handler.NewHealthHandler(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		req = httptest.NewRequest(http.MethodGet, "/healthz", http.NoBody)
+		rec = httptest.NewRecorder()
+	)
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var got handler.HealthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got.Status != handler.StatusOK {
+		t.Errorf("ServeHTTP() status = %q, want %q", got.Status, handler.StatusOK)
+	}
+}
+
+func TestReadyHandler_ServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	var (
+		pass = handler.Check{
+			Name: "pass",
+			Run:  func(_ context.Context) error { return nil },
+		}
+		fail = handler.Check{
+			Name: "fail",
+			Run:  func(_ context.Context) error { return errors.New("not ready") },
+		}
+	)
+
+	tests := []struct {
+		name       string
+		checks     []handler.Check
+		wantStatus int
+		wantChecks map[string]*handler.CheckStatus
+	}{
+		{
+			name:       "Every check passes",
+			checks:     []handler.Check{pass},
+			wantStatus: http.StatusOK,
+			wantChecks: map[string]*handler.CheckStatus{
+				"pass": {Status: handler.StatusOK},
+			},
+		},
+		{
+			name:       "A check fails",
+			checks:     []handler.Check{pass, fail},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]*handler.CheckStatus{
+				"pass": {Status: handler.StatusOK},
+				"fail": {Status: handler.StatusUnavailable, Error: "not ready"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				h   = handler.NewReadyHandler(tt.checks, slog.New(slog.NewTextHandler(io.Discard, nil)))
+				req = httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody)
+				rec = httptest.NewRecorder()
+			)
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, "application/json")
+			}
+
+			var got handler.HealthResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for name, want := range tt.wantChecks {
+				if check := got.Checks[name]; check == nil || *check != *want {
+					t.Errorf("ServeHTTP() check %q = %+v, want %+v", name, check, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	t.Parallel()
+
+	var (
+		runs  int
+		check = handler.CachedCheck("upstreams", 50*time.Millisecond, func(_ context.Context) error {
+			runs++
+
+			return nil
+		})
+	)
+
+	for i := 0; i < 3; i++ {
+		if err := check.Run(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if runs != 1 {
+		t.Errorf("CachedCheck() ran %d times, want 1", runs)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := check.Run(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if runs != 2 {
+		t.Errorf("CachedCheck() ran %d times after expiring, want 2", runs)
+	}
+}
+
+func TestCachedCheck_Canceled(t *testing.T) {
+	t.Parallel()
+
+	var (
+		runs    atomic.Int32
+		release = make(chan struct{})
+		check   = handler.CachedCheck("upstreams", time.Hour, func(ctx context.Context) error {
+			runs.Add(1)
+
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	)
+
+	// The caller giving up doesn't abort the check, whose result is kept for
+	// the next caller.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := check.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run() error = %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+
+	if err := check.Run(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := runs.Load(); got != 1 {
+		t.Errorf("CachedCheck() ran %d times, want 1", got)
+	}
+}
+
+func TestCachedCheck_ContextError(t *testing.T) {
+	t.Parallel()
+
+	var (
+		runs  atomic.Int32
+		check = handler.CachedCheck("upstreams", time.Hour, func(_ context.Context) error {
+			if runs.Add(1) == 1 {
+				return context.DeadlineExceeded
+			}
+
+			return nil
+		})
+	)
+
+	if err := check.Run(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The timed out run isn't remembered, so the check runs again.
+	if err := check.Run(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := runs.Load(); got != 2 {
+		t.Errorf("CachedCheck() ran %d times, want 2", got)
+	}
+}
+
+func TestCachedCheck_Running(t *testing.T) {
+	t.Parallel()
+
+	var (
+		runs         atomic.Int32
+		errTestCheck = errors.New("not ready")
+		started      = make(chan struct{})
+		release      = make(chan struct{})
+		check        = handler.CachedCheck("upstreams", time.Millisecond, func(_ context.Context) error {
+			if runs.Add(1) == 1 {
+				return errTestCheck
+			}
+
+			close(started)
+			<-release
+
+			return nil
+		})
+	)
+
+	if err := check.Run(context.Background()); !errors.Is(err, errTestCheck) {
+		t.Fatalf("Run() error = %v, want %v", err, errTestCheck)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan error)
+
+	go func() {
+		done <- check.Run(context.Background())
+	}()
+
+	<-started
+
+	// Callers arriving while the check runs get the previous result right
+	// away.
+	if err := check.Run(context.Background()); !errors.Is(err, errTestCheck) {
+		t.Errorf("Run() error = %v, want the previous %v", err, errTestCheck)
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
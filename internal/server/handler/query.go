@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/libravatar"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+const (
+	// ErrInvalidSize is returned when the requested size isn't an integer.
+	ErrInvalidSize xerrors.Error = "invalid size; must be an integer"
+
+	// ErrInvalidDefault is returned when the requested default image is
+	// neither a known style nor an HTTP or HTTPS URL.
+	ErrInvalidDefault xerrors.Error = "invalid default image"
+
+	// ErrInvalidRating is returned when the requested rating is invalid.
+	ErrInvalidRating xerrors.Error = "invalid rating; must be g, pg, r, or x"
+
+	// ErrInvalidForceDefault is returned when the force default parameter is
+	// invalid.
+	ErrInvalidForceDefault xerrors.Error = "invalid force default; must be y or n"
+
+	// ErrInvalidDomain is returned when the domain hint isn't a valid domain
+	// name.
+	ErrInvalidDomain xerrors.Error = "invalid domain"
+)
+
+const (
+	// MinSize is the smallest avatar size that can be requested.
+	MinSize int = 1
+
+	// MaxSize is the largest avatar size that can be requested.
+	MaxSize int = 2048
+)
+
+// _defaultImages maps the default image styles accepted by Gravatar to their
+// canonical names.
+var _defaultImages = map[string]string{
+	"404":        "404",
+	"mp":         "mp",
+	"mm":         "mp",
+	"mysteryman": "mp",
+	"identicon":  "identicon",
+	"monsterid":  "monsterid",
+	"wavatar":    "wavatar",
+	"retro":      "retro",
+	"robohash":   "robohash",
+	"blank":      "blank",
+}
+
+// _ratings is the set of ratings accepted by Gravatar.
+var _ratings = map[string]struct{}{
+	"g":  {},
+	"pg": {},
+	"r":  {},
+	"x":  {},
+}
+
+// NormalizeQueryString returns the canonical form of an avatar query string,
+// so equivalent requests share a cache key and an upstream request.
+//
+// Only the parameters documented by Gravatar are kept, under their short names:
+// s, d, r, and f. Sizes are clamped to the range Gravatar supports, style names
+// and ratings are lowercased, and parameters set to Gravatar's defaults are
+// omitted. An error is returned if any of them has an invalid value.
+//
+// The domain parameter, used to find the federated Libravatar server of the
+// email address, is kept as well, lowercased and without a trailing dot.
+func NormalizeQueryString(query string) (string, error) {
+	if query == "" {
+		return "", nil
+	}
+
+	parsedQuery, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	normalized := url.Values{}
+
+	if value := firstValue(parsedQuery, "s", "size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSize, value)
+		}
+
+		size = min(max(size, MinSize), MaxSize)
+
+		if size != DefaultSize {
+			normalized.Set("s", strconv.Itoa(size))
+		}
+	}
+
+	if value := firstValue(parsedQuery, "d", "default"); value != "" {
+		defaultImage, err := normalizeDefaultImage(value)
+		if err != nil {
+			return "", err
+		}
+
+		normalized.Set("d", defaultImage)
+	}
+
+	if value := firstValue(parsedQuery, "r", "rating"); value != "" {
+		rating := strings.ToLower(value)
+
+		if _, ok := _ratings[rating]; !ok {
+			return "", fmt.Errorf("%w: %q", ErrInvalidRating, value)
+		}
+
+		if rating != "g" {
+			normalized.Set("r", rating)
+		}
+	}
+
+	if value := firstValue(parsedQuery, "f", "forcedefault"); value != "" {
+		switch strings.ToLower(value) {
+		case "y":
+			normalized.Set("f", "y")
+		case "n":
+		default:
+			return "", fmt.Errorf("%w: %q", ErrInvalidForceDefault, value)
+		}
+	}
+
+	if value := parsedQuery.Get("domain"); value != "" {
+		domain := strings.ToLower(strings.TrimSuffix(value, "."))
+
+		if !libravatar.IsDomain(domain) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidDomain, value)
+		}
+
+		normalized.Set("domain", domain)
+	}
+
+	return normalized.Encode(), nil
+}
+
+// normalizeDefaultImage returns the canonical form of a default image, which is
+// either one of the styles supported by Gravatar or an HTTP or HTTPS URL.
+func normalizeDefaultImage(value string) (string, error) {
+	if style, ok := _defaultImages[strings.ToLower(value)]; ok {
+		return style, nil
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDefault, value)
+	}
+
+	return value, nil
+}
+
+// firstValue returns the value of the first of the given query parameters
+// that is set, so both the short and long forms Gravatar accepts are honored.
+func firstValue(values url.Values, keys ...string) string {
+	for _, key := range keys {
+		if value := values.Get(key); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,122 @@
+package handler_test
+
+import (
+	"errors"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+)
+
+func TestNormalizeQueryString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "Empty query",
+			query: "",
+			want:  "",
+		},
+		{
+			name:  "Aliases",
+			query: "size=120&default=identicon&rating=pg&forcedefault=y",
+			want:  "d=identicon&f=y&r=pg&s=120",
+		},
+		{
+			name:  "Short names take precedence",
+			query: "size=120&s=60",
+			want:  "s=60",
+		},
+		{
+			name:  "Unknown parameters",
+			query: "s=120&foo=bar&_=123",
+			want:  "s=120",
+		},
+		{
+			name:  "Default values",
+			query: "s=80&r=g&f=n",
+			want:  "",
+		},
+		{
+			name:  "Size too small",
+			query: "s=0",
+			want:  "s=1",
+		},
+		{
+			name:  "Size too large",
+			query: "s=4096",
+			want:  "s=2048",
+		},
+		{
+			name:  "Legacy default image name",
+			query: "d=MM",
+			want:  "d=mp",
+		},
+		{
+			name:  "Custom default image",
+			query: "d=https%3A%2F%2Fwww.example.com%2Favatar.png",
+			want:  "d=https%3A%2F%2Fwww.example.com%2Favatar.png",
+		},
+		{
+			name:  "Uppercase rating",
+			query: "r=X",
+			want:  "r=x",
+		},
+		{
+			name:  "Domain",
+			query: "s=120&domain=Example.org.",
+			want:  "domain=example.org&s=120",
+		},
+		{
+			name:    "Invalid domain",
+			query:   "domain=example.org%2Favatar",
+			wantErr: handler.ErrInvalidDomain,
+		},
+		{
+			name:    "Invalid size",
+			query:   "s=large",
+			wantErr: handler.ErrInvalidSize,
+		},
+		{
+			name:    "Invalid default image",
+			query:   "d=unknown",
+			wantErr: handler.ErrInvalidDefault,
+		},
+		{
+			name:    "Default image with unsupported scheme",
+			query:   "d=file%3A%2F%2F%2Fetc%2Fpasswd",
+			wantErr: handler.ErrInvalidDefault,
+		},
+		{
+			name:    "Invalid rating",
+			query:   "r=nc17",
+			wantErr: handler.ErrInvalidRating,
+		},
+		{
+			name:    "Invalid force default",
+			query:   "f=maybe",
+			wantErr: handler.ErrInvalidForceDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := handler.NormalizeQueryString(tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NormalizeQueryString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("NormalizeQueryString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
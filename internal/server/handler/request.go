@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~jamesponddotco/xstd-go/xhash/xfnv"
+)
+
+// avatarRequest describes a request for an avatar once its query string is
+// normalized.
+type avatarRequest struct {
+	// fallback is the default image used when no upstream has an avatar for
+	// the hash. Nil if the upstream's own default image is used.
+	fallback *defaultImage
+
+	// hash is the hash of the email address the avatar belongs to.
+	hash string
+
+	// domain is the domain of the email address, used to find its federated
+	// Libravatar server. Empty if the request doesn't give one.
+	domain string
+
+	// query is the query string sent to upstreams for the requested image.
+	query string
+
+	// normalizedQuery is the canonical form of the request's query string.
+	normalizedQuery string
+
+	// cacheKey is the cache key of the requested image.
+	cacheKey string
+
+	// masterQuery is the query string sent to upstreams for the master image
+	// the requested size is derived from.
+	masterQuery string
+
+	// masterKey is the cache key of the master image.
+	masterKey string
+
+	// mediaType is the media type forced by the request, if any.
+	mediaType string
+
+	// size is the requested width and height of the avatar in pixels.
+	size int
+}
+
+// newAvatarRequest returns the avatar request for the given hash, forced media
+// type, and query string. Sizes up to masterSize are derived from a master
+// image of that size, while larger sizes are fetched as they are.
+func newAvatarRequest(hash, mediaType, rawQuery string, masterSize int) (*avatarRequest, error) {
+	query, err := NormalizeQueryString(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	size := DefaultSize
+
+	if n, err := strconv.Atoi(values.Get("s")); err == nil {
+		size = n
+	}
+
+	// Hashes are hexadecimal, so the same avatar can be requested in any
+	// case. Lowercasing it lets every form share one cache entry.
+	hash = strings.ToLower(hash)
+
+	req := &avatarRequest{
+		hash:            hash,
+		domain:          values.Get("domain"),
+		normalizedQuery: query,
+		mediaType:       mediaType,
+		size:            size,
+
+		// The cache key depends on the requested default image, even though
+		// it isn't sent upstream.
+		cacheKey: xfnv.String(hash + "?" + query),
+	}
+
+	// Default images are generated or fetched locally, so upstreams are only
+	// asked whether the avatar exists.
+	req.fallback = newDefaultImage(hash, values, size)
+
+	// The domain only selects the server, so it isn't part of the query sent
+	// to it.
+	values.Del("domain")
+
+	req.query = values.Encode()
+
+	values.Set("s", strconv.Itoa(max(masterSize, size)))
+
+	// The master key is prefixed so it never matches the key of a request,
+	// even when the requested size is the master size.
+	req.masterQuery = values.Encode()
+	req.masterKey = xfnv.String("master:" + req.domain + "/" + hash + "?" + req.masterQuery)
+
+	return req, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+const (
+	// ErrNotListening is returned by the listener readiness check when the
+	// server isn't accepting connections, such as while shutting down.
+	ErrNotListening xerrors.Error = "server is not accepting connections"
+
+	// ErrCacheProbe is returned by the cache readiness check when the cache
+	// can't store entries.
+	ErrCacheProbe xerrors.Error = "cache is not writable"
+
+	// ErrNoUpstream is returned by the upstream readiness check when no
+	// upstream answers.
+	ErrNoUpstream xerrors.Error = "no upstream is reachable"
+)
+
+// _upstreamProbeHash is the hash asked to upstreams by the upstream readiness
+// check, which no email address is expected to have.
+const _upstreamProbeHash string = "00000000000000000000000000000000"
+
+// newReadyChecks returns the readiness checks of the server: whether it
+// accepts connections, whether the cache is usable, and, if enabled, whether
+// any upstream answers.
+func newReadyChecks(
+	cfg *config.Server,
+	listening *atomic.Bool,
+	cacheInstance cache.Backend,
+	avatarHandler *handler.AvatarHandler,
+	fetchClient *fetch.Client,
+) []handler.Check {
+	checks := []handler.Check{
+		{
+			Name: "listener",
+			Run: func(_ context.Context) error {
+				if !listening.Load() {
+					return ErrNotListening
+				}
+
+				return nil
+			},
+		},
+		{
+			Name: "cache",
+			Run: func(_ context.Context) error {
+				return probeCache(cacheInstance)
+			},
+		},
+	}
+
+	if cfg.ReadyUpstreamProbe {
+		checks = append(checks, handler.CachedCheck("upstreams", cfg.ReadyUpstreamProbeTTL.Duration, func(ctx context.Context) error {
+			return probeUpstreams(ctx, avatarHandler, fetchClient)
+		}))
+	}
+
+	return checks
+}
+
+// probeCache checks that the cache can still store avatars. The probe leaves
+// the cached avatars untouched, so frequent checks never evict them.
+func probeCache(cacheInstance cache.Backend) error {
+	if err := cacheInstance.Probe(); err != nil {
+		return fmt.Errorf("%w: %w", ErrCacheProbe, err)
+	}
+
+	return nil
+}
+
+// probeUpstreams asks the current upstreams for an avatar that doesn't exist
+// and succeeds as soon as one of them answers, with either an image or a 404.
+// Probes bypass the rate limit, so they never delay fetching avatars.
+func probeUpstreams(ctx context.Context, avatarHandler *handler.AvatarHandler, fetchClient *fetch.Client) error {
+	var failures []string
+
+	for _, u := range avatarHandler.Settings().Upstreams {
+		err := fetchClient.Probe(ctx, u.URL(_upstreamProbeHash, "d=404"))
+		if err == nil || errors.Is(err, fetch.ErrNotFound) {
+			return nil
+		}
+
+		failures = append(failures, u.Name+": "+err.Error())
+	}
+
+	if len(failures) == 0 {
+		return ErrNoUpstream
+	}
+
+	return fmt.Errorf("%w: %s", ErrNoUpstream, strings.Join(failures, "; "))
+}
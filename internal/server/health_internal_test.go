@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/timeutil"
+)
+
+// failingBackend is a cache backend whose probes always fail.
+type failingBackend struct {
+	cache.Backend
+}
+
+// Probe implements cache.Backend.
+func (failingBackend) Probe() error {
+	return cache.ErrTypeAssertion
+}
+
+func TestProbeCache(t *testing.T) {
+	t.Parallel()
+
+	newDisk := func(t *testing.T, capacity uint) *cache.DiskCache {
+		t.Helper()
+
+		c, err := cache.NewDisk(t.TempDir(), &cache.Options{
+			Expiration: timeutil.CacheDuration{Duration: time.Minute},
+			Capacity:   capacity,
+		})
+		if err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name string
+
+		// backend returns the cache to probe, with an avatar already stored
+		// in it unless it fails.
+		backend func(t *testing.T) cache.Backend
+		wantErr error
+	}{
+		{
+			name: "Memory cache",
+			backend: func(*testing.T) cache.Backend {
+				return cache.NewWithOptions(&cache.Options{
+					Expiration: timeutil.CacheDuration{Duration: time.Minute},
+					Capacity:   16,
+				})
+			},
+		},
+		{
+			name: "Disk cache",
+			backend: func(t *testing.T) cache.Backend {
+				return newDisk(t, 16)
+			},
+		},
+		{
+			// A probe storing an entry would evict the avatar.
+			name: "Full cache",
+			backend: func(t *testing.T) cache.Backend {
+				return newDisk(t, 1)
+			},
+		},
+		{
+			name: "Removed cache directory",
+			backend: func(t *testing.T) cache.Backend {
+				dir := filepath.Join(t.TempDir(), "cache")
+
+				c, err := cache.NewDisk(dir, &cache.Options{
+					Expiration: timeutil.CacheDuration{Duration: time.Minute},
+				})
+				if err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+
+				if err = os.RemoveAll(dir); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+
+				return c
+			},
+			wantErr: ErrCacheProbe,
+		},
+		{
+			name: "Failing cache",
+			backend: func(*testing.T) cache.Backend {
+				return failingBackend{}
+			},
+			wantErr: ErrCacheProbe,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			backend := tt.backend(t)
+
+			if tt.wantErr == nil {
+				if err := backend.Set("avatar", &cache.Item{Value: []byte("avatar")}); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			}
+
+			if err := probeCache(backend); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("probeCache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			// The probe leaves the cache's contents untouched, so it never
+			// evicts avatars.
+			if _, err := backend.Get("avatar"); err != nil {
+				t.Errorf("Cache.Get() error = %v, want the avatar", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+const (
+	// ErrNotSocket is returned when the path of the Unix domain socket exists
+	// but isn't a socket, so it isn't replaced.
+	ErrNotSocket xerrors.Error = "path exists and is not a socket"
+
+	// ErrInvalidSocketOwner is returned when the owner of the Unix domain
+	// socket can't be found.
+	ErrInvalidSocketOwner xerrors.Error = "invalid socket owner"
+)
+
+// listen opens the listener the server accepts connections on, either a TCP
+// listener on the configured address or a Unix domain socket.
+func listen(cfg *config.Server) (net.Listener, error) {
+	if cfg.Listener == config.ListenerUnix {
+		return listenUnix(cfg)
+	}
+
+	ln, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return ln, nil
+}
+
+// listenUnix opens a Unix domain socket, replacing the one left behind by a
+// previous run, and sets its file mode and owner. The socket is removed when
+// the listener is closed.
+func listenUnix(cfg *config.Server) (net.Listener, error) {
+	mode, err := cfg.SocketFileMode()
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	if err = removeStaleSocket(cfg.Socket); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	if err = os.Chmod(cfg.Socket, mode); err != nil {
+		_ = ln.Close()
+
+		return nil, fmt.Errorf("failed to set socket mode: %w", err)
+	}
+
+	if cfg.SocketOwner == "" {
+		return ln, nil
+	}
+
+	uid, gid, err := lookupOwner(cfg.SocketOwner)
+	if err != nil {
+		_ = ln.Close()
+
+		return nil, err
+	}
+
+	if err = os.Chown(cfg.Socket, uid, gid); err != nil {
+		_ = ln.Close()
+
+		return nil, fmt.Errorf("failed to set socket owner: %w", err)
+	}
+
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket at the given path, if any. Anything
+// other than a socket is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s", ErrNotSocket, path)
+	}
+
+	if err = os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	return nil
+}
+
+// lookupOwner returns the user and group IDs of an owner given as user or
+// user:group, with names or numeric IDs. The group ID is -1, leaving the group
+// unchanged, if the owner has no group.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	username, group, _ := strings.Cut(owner, ":")
+
+	uid, err = strconv.Atoi(username)
+	if err != nil {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: %w", ErrInvalidSocketOwner, err)
+		}
+
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("%w: %w", ErrInvalidSocketOwner, err)
+		}
+	}
+
+	if group == "" {
+		return uid, -1, nil
+	}
+
+	gid, err = strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: %w", ErrInvalidSocketOwner, err)
+		}
+
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("%w: %w", ErrInvalidSocketOwner, err)
+		}
+	}
+
+	return uid, gid, nil
+}
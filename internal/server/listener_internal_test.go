@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr error
+	}{
+		{
+			name: "New socket",
+		},
+		{
+			name: "Stale socket",
+			setup: func(t *testing.T, path string) {
+				t.Helper()
+
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+
+				// Leave the socket file behind, as a crash would.
+				ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+				if err = ln.Close(); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Regular file",
+			setup: func(t *testing.T, path string) {
+				t.Helper()
+
+				if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+					t.Fatalf("Setup error: %v", err)
+				}
+			},
+			wantErr: ErrNotSocket,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "privytar.sock")
+
+			if tt.setup != nil {
+				tt.setup(t, path)
+			}
+
+			ln, err := listen(&config.Server{
+				Listener:   config.ListenerUnix,
+				Socket:     path,
+				SocketMode: "0600",
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("listen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			t.Cleanup(func() { _ = ln.Close() })
+
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if info.Mode()&fs.ModeSocket == 0 {
+				t.Errorf("listen() created %v, want a socket", info.Mode())
+			}
+
+			if got := info.Mode().Perm(); got != 0o600 {
+				t.Errorf("listen() socket mode = %v, want %v", got, fs.FileMode(0o600))
+			}
+		})
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		owner   string
+		wantUID int
+		wantGID int
+		wantErr error
+	}{
+		{
+			name:    "Numeric user",
+			owner:   "1000",
+			wantUID: 1000,
+			wantGID: -1,
+		},
+		{
+			name:    "Numeric user and group",
+			owner:   "1000:33",
+			wantUID: 1000,
+			wantGID: 33,
+		},
+		{
+			name:    "Unknown user",
+			owner:   "privytar-unknown-user",
+			wantErr: ErrInvalidSocketOwner,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			uid, gid, err := lookupOwner(tt.owner)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("lookupOwner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if uid != tt.wantUID || gid != tt.wantGID {
+				t.Errorf("lookupOwner() = %d:%d, want %d:%d", uid, gid, tt.wantUID, tt.wantGID)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+)
+
+// reloadOnHangup reloads the configuration and the TLS certificate whenever
+// the process receives a SIGHUP, until the context is canceled.
+func (s *Server) reloadOnHangup(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			s.reload(ctx)
+		}
+	}
+}
+
+// reload loads the configuration file again and applies the settings that can
+// be changed while the server runs: the cache limits and expiration times, the
+// log level, the headers sent with responses, the upstreams and the rate of
+// requests sent to them, custom default images, and Libravatar federation.
+// Settings that only apply after a restart are logged when they change.
+//
+// If the new configuration is invalid, the error is logged and the current
+// one is kept.
+func (s *Server) reload(ctx context.Context) {
+	var (
+		settings *handler.Settings
+		level    slog.Level
+	)
+
+	cfg, err := config.LoadConfig(s.cfg.Path())
+	if err == nil {
+		settings, err = newSettings(cfg, s.discovery)
+	}
+
+	if err == nil {
+		level, err = cfg.Server.Level()
+	}
+
+	if err != nil {
+		s.logger.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"failed to reload configuration; keeping the current one",
+			slog.String("path", s.cfg.Path()),
+			slog.String("error", err.Error()),
+		)
+
+		return
+	}
+
+	s.logLevel.Set(level)
+	s.service.Store(cfg.Service)
+	s.avatarHandler.Update(settings)
+	s.fetchClient.SetRateLimit(cfg.Server.UpstreamRateLimit, cfg.Server.UpstreamRateBurst)
+
+	if cfg.Server.CacheBackend == s.cacheBackend {
+		if err = s.cache.SetOptions(newCacheOptions(cfg.Server)); err != nil {
+			s.logger.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"failed to apply new cache settings",
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	s.logger.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"reloaded configuration",
+		slog.String("path", s.cfg.Path()),
+	)
+
+	if changed := restartRequired(s.cfg, cfg); len(changed) > 0 {
+		s.logger.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"some settings changed but only apply after a restart",
+			slog.String("settings", strings.Join(changed, ", ")),
+		)
+	}
+
+	s.cfg = cfg
+
+	if s.certs == nil {
+		return
+	}
+
+	if err = s.certs.Reload(); err != nil {
+		s.logger.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"failed to reload TLS certificate; keeping the current one",
+			slog.String("error", err.Error()),
+		)
+
+		return
+	}
+
+	s.logger.LogAttrs(ctx, slog.LevelInfo, "reloaded TLS certificate")
+}
+
+// restartRequired returns the names of the settings that differ between the
+// previously loaded configuration and the new one, but can't be changed while
+// the server runs.
+func restartRequired(running, loaded *config.Config) []string {
+	settings := []struct {
+		name    string
+		running any
+		loaded  any
+	}{
+		{"service.name", running.Service.Name, loaded.Service.Name},
+		{"service.contact", running.Service.Contact, loaded.Service.Contact},
+		{"server.tls", running.Server.TLS, loaded.Server.TLS},
+		{"server.acme", running.Server.ACME, loaded.Server.ACME},
+		{"server.listener", running.Server.Listener, loaded.Server.Listener},
+		{"server.address", running.Server.Address, loaded.Server.Address},
+		{"server.socket", running.Server.Socket, loaded.Server.Socket},
+		{"server.socketMode", running.Server.SocketMode, loaded.Server.SocketMode},
+		{"server.socketOwner", running.Server.SocketOwner, loaded.Server.SocketOwner},
+		{"server.pid", running.Server.PID, loaded.Server.PID},
+		{"server.cacheBackend", running.Server.CacheBackend, loaded.Server.CacheBackend},
+		{"server.cacheDirectory", running.Server.CacheDirectory, loaded.Server.CacheDirectory},
+		{"server.masterSize", running.Server.MasterSize, loaded.Server.MasterSize},
+		{"server.readyUpstreamProbe", running.Server.ReadyUpstreamProbe, loaded.Server.ReadyUpstreamProbe},
+		{"server.readyUpstreamProbeTTL", running.Server.ReadyUpstreamProbeTTL, loaded.Server.ReadyUpstreamProbeTTL},
+		{"server.logRequests", running.Server.LogRequests, loaded.Server.LogRequests},
+		{"optimization", running.Optimization, loaded.Optimization},
+	}
+
+	var changed []string
+
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.running, setting.loaded) {
+			changed = append(changed, setting.name)
+		}
+	}
+
+	return changed
+}
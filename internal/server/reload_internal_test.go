@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/config"
+	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+	"git.sr.ht/~jamesponddotco/privytar/internal/libravatar"
+	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+	"git.sr.ht/~jamesponddotco/privytar/internal/timeutil"
+)
+
+func TestRestartRequired(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		change func(cfg *config.Config)
+		want   []string
+	}{
+		{
+			name:   "Nothing changed",
+			change: func(_ *config.Config) {},
+		},
+		{
+			name: "Reloadable settings changed",
+			change: func(cfg *config.Config) {
+				cfg.Service.PrivacyPolicy = "https://www.example.com/new-privacy"
+				cfg.Server.CacheTTL = timeutil.CacheDuration{Duration: 2 * time.Hour}
+				cfg.Server.CacheCapacity = 16
+				cfg.Server.LogLevel = "debug"
+				cfg.Server.Upstreams = nil
+				cfg.Server.UpstreamRateLimit = 10
+				cfg.Server.UpstreamRateBurst = 5
+			},
+		},
+		{
+			name: "Listener and optimization changed",
+			change: func(cfg *config.Config) {
+				cfg.Server.Address = ":2000"
+				cfg.Optimization.Quality = 90
+			},
+			want: []string{"server.address", "optimization"},
+		},
+		{
+			name: "TLS certificate changed",
+			change: func(cfg *config.Config) {
+				cfg.Server.TLS.Certificate = "/path/to/new.crt"
+			},
+			want: []string{"server.tls"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				running = testConfig()
+				loaded  = testConfig()
+			)
+
+			tt.change(loaded)
+
+			if got := restartRequired(running, loaded); !slices.Equal(got, tt.want) {
+				t.Errorf("restartRequired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	t.Parallel()
+
+	var (
+		path = filepath.Join(t.TempDir(), "config.json")
+		logs bytes.Buffer
+	)
+
+	writeConfig := func(change func(cfg *config.Config)) {
+		t.Helper()
+
+		cfg := testConfig()
+		change(cfg)
+
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+
+		if err = os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("Setup error: %v", err)
+		}
+	}
+
+	writeConfig(func(_ *config.Config) {})
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	var (
+		discovery    = libravatar.New(nil)
+		fetchClient  = fetch.New("TestService", "test@example.com", nil)
+		cacheBackend = cache.NewWithOptions(newCacheOptions(cfg.Server))
+		service      = &atomic.Pointer[config.Service]{}
+	)
+
+	settings, err := newSettings(cfg, discovery)
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+
+	service.Store(cfg.Service)
+
+	s := &Server{
+		logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		logLevel: &slog.LevelVar{},
+		cfg:      cfg,
+		cache:    cacheBackend,
+		avatarHandler: handler.NewAvatarHandler(
+			settings.Homepage,
+			settings.BaseURL,
+			cfg.Server.MasterSize,
+			settings.Upstreams,
+			settings.CacheControl,
+			settings.CustomDefaults,
+			settings.Federation,
+			fetchClient,
+			cacheBackend,
+			slog.New(slog.NewTextHandler(io.Discard, nil)),
+		),
+		fetchClient:  fetchClient,
+		discovery:    discovery,
+		service:      service,
+		cacheBackend: cfg.Server.CacheBackend,
+	}
+
+	// A setting that needs a restart is reported once, by the reload that
+	// changes it, and federation keeps using the same discovery.
+	writeConfig(func(cfg *config.Config) {
+		cfg.Server.Address = ":2000"
+		cfg.Server.LibravatarFederation = true
+	})
+
+	for i := 0; i < 2; i++ {
+		s.reload(context.Background())
+	}
+
+	if got := s.cfg.Server.Address; got != ":2000" {
+		t.Errorf("reload() address = %q, want %q", got, ":2000")
+	}
+
+	federation := s.avatarHandler.Settings().Federation
+	if federation == nil || federation.Discovery != discovery {
+		t.Errorf("reload() federation = %+v, want the server's discovery", federation)
+	}
+
+	if got := strings.Count(logs.String(), "only apply after a restart"); got != 1 {
+		t.Errorf("reload() reported settings needing a restart %d times, want 1", got)
+	}
+}
+
+// testConfig returns a valid configuration serving HTTPS.
+func testConfig() *config.Config {
+	return &config.Config{
+		Service: &config.Service{
+			Name:           "Privytar",
+			Homepage:       "https://www.example.com",
+			Contact:        "contact@example.com",
+			PrivacyPolicy:  "https://www.example.com/privacy",
+			TermsOfService: "https://www.example.com/terms",
+		},
+		Server: &config.Server{
+			TLS: &config.TLS{
+				Certificate: "/path/to/certificate.crt",
+				Key:         "/path/to/private.key",
+				Version:     "1.3",
+			},
+			Listener:      config.ListenerTLS,
+			Address:       ":1997",
+			CacheCapacity: 8192,
+			CacheTTL:      timeutil.CacheDuration{Duration: time.Hour},
+			LogLevel:      "info",
+			Upstreams: []*config.Upstream{
+				{Name: "gravatar", URL: "https://secure.gravatar.com/avatar/{hash}?{query}"},
+			},
+		},
+		Optimization: &config.Optimization{
+			Quality:     60,
+			Compression: 9,
+		},
+	}
+}
@@ -7,46 +7,69 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"git.sr.ht/~jamesponddotco/privytar/internal/cache"
+	"git.sr.ht/~jamesponddotco/privytar/internal/certstore"
 	"git.sr.ht/~jamesponddotco/privytar/internal/config"
 	"git.sr.ht/~jamesponddotco/privytar/internal/endpoint"
 	"git.sr.ht/~jamesponddotco/privytar/internal/fetch"
+	"git.sr.ht/~jamesponddotco/privytar/internal/libravatar"
 	"git.sr.ht/~jamesponddotco/privytar/internal/server/handler"
+	"git.sr.ht/~jamesponddotco/privytar/internal/upstream"
 	"git.sr.ht/~jamesponddotco/xstd-go/xcrypto/xtls"
 	"git.sr.ht/~jamesponddotco/xstd-go/xnet/xhttp"
 	"git.sr.ht/~jamesponddotco/xstd-go/xnet/xhttp/xmiddleware"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// WriteTimeout is the maximum amount of time spent answering a request. It
+// leaves room for the handler to answer with an error after giving up on a
+// slow upstream.
+const WriteTimeout time.Duration = handler.FetchTimeout + 2*time.Second
+
 // Server represents a Privytar server.
 type Server struct {
-	httpServer *http.Server
-	logger     *slog.Logger
+	httpServer    *http.Server
+	logger        *slog.Logger
+	logLevel      *slog.LevelVar
+	acmeServer    *http.Server
+	cfg           *config.Config
+	certs         *certstore.Store
+	cache         cache.Backend
+	avatarHandler *handler.AvatarHandler
+	fetchClient   *fetch.Client
+	discovery     *libravatar.Discovery
+	service       *atomic.Pointer[config.Service]
+	listening     *atomic.Bool
+
+	// cacheBackend is the backend of the running cache, which only changes
+	// on restart.
+	cacheBackend string
 }
 
-// New creates a new Privytar server.
-func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
-	cert, err := tls.LoadX509KeyPair(cfg.Server.TLS.Certificate, cfg.Server.TLS.Key)
+// New creates a new Privytar server. The minimum level of the messages logged
+// is changed through logLevel when the configuration is reloaded.
+func New(cfg *config.Config, logger *slog.Logger, logLevel *slog.LevelVar) (*Server, error) {
+	certs, err := newCertStore(cfg.Server, logger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
-	}
-
-	var tlsConfig *tls.Config
-
-	if cfg.Server.TLS.Version == "1.3" {
-		tlsConfig = xtls.ModernServerConfig()
+		return nil, fmt.Errorf("%w", err)
 	}
 
-	if cfg.Server.TLS.Version == "1.2" {
-		tlsConfig = xtls.IntermediateServerConfig()
+	acmeManager, err := newACMEManager(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
 	}
 
-	tlsConfig.Certificates = []tls.Certificate{cert}
+	service := &atomic.Pointer[config.Service]{}
+	service.Store(cfg.Service)
 
 	middlewares := []func(http.Handler) http.Handler{
 		func(h http.Handler) http.Handler { return xmiddleware.PanicRecovery(logger, h) },
@@ -62,8 +85,7 @@ func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
 				h,
 			)
 		},
-		func(h http.Handler) http.Handler { return xmiddleware.PrivacyPolicy(cfg.Service.PrivacyPolicy, h) },
-		func(h http.Handler) http.Handler { return xmiddleware.TermsOfService(cfg.Service.TermsOfService, h) },
+		func(h http.Handler) http.Handler { return serviceHeaders(service, h) },
 		func(h http.Handler) http.Handler { return xmiddleware.CORS(nil, logger, h) },
 	}
 
@@ -75,17 +97,49 @@ func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
 		})
 	}
 
+	cacheInstance, err := newCache(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %w", err)
+	}
+
+	// The same discovery is kept across reloads, along with the servers it
+	// has already found.
+	discovery := libravatar.New(nil)
+
+	settings, err := newSettings(cfg, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
 	var (
-		cacheInstance = cache.New(cfg.Server.CacheCapacity, cfg.Server.CacheTTL)
-		fetchInstance = fetch.New(cfg.Service.Name, cfg.Service.Contact)
-		avatarHandler = handler.NewAvatarHandler(cfg.Service.Homepage, fetchInstance, cacheInstance, logger)
+		fetchOptions = &fetch.Options{
+			Optimize:      !cfg.Optimization.Disabled,
+			Quality:       cfg.Optimization.Quality,
+			Compression:   cfg.Optimization.Compression,
+			StripMetadata: !cfg.Optimization.KeepMetadata,
+		}
+		fetchInstance = fetch.New(cfg.Service.Name, cfg.Service.Contact, fetchOptions)
+		avatarHandler = handler.NewAvatarHandler(
+			settings.Homepage,
+			settings.BaseURL,
+			cfg.Server.MasterSize,
+			settings.Upstreams,
+			settings.CacheControl,
+			settings.CustomDefaults,
+			settings.Federation,
+			fetchInstance,
+			cacheInstance,
+			logger,
+		)
 	)
 
+	fetchInstance.SetRateLimit(cfg.Server.UpstreamRateLimit, cfg.Server.UpstreamRateBurst)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc(endpoint.Root, func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case endpoint.Root:
-			http.Redirect(w, r, cfg.Service.Homepage, http.StatusMovedPermanently)
+			http.Redirect(w, r, service.Load().Homepage, http.StatusMovedPermanently)
 		default:
 			response := xhttp.ResponseError{
 				Code:    http.StatusNotFound,
@@ -98,24 +152,75 @@ func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
 
 	mux.Handle(endpoint.Avatar, xmiddleware.Chain(avatarHandler, middlewares...))
 
+	// Health endpoints are meant for load balancers and supervisors, so they
+	// skip the headers, user agent check, and access log of the API.
+	var (
+		listening     = &atomic.Bool{}
+		healthHandler = handler.NewHealthHandler(logger)
+		readyHandler  = handler.NewReadyHandler(
+			newReadyChecks(cfg.Server, listening, cacheInstance, avatarHandler, fetchInstance),
+			logger,
+		)
+		healthMiddlewares = []func(http.Handler) http.Handler{
+			func(h http.Handler) http.Handler { return xmiddleware.PanicRecovery(logger, h) },
+			func(h http.Handler) http.Handler {
+				return xmiddleware.AcceptRequests([]string{http.MethodGet, http.MethodHead}, logger, h)
+			},
+		}
+	)
+
+	mux.Handle(endpoint.Health, xmiddleware.Chain(healthHandler, healthMiddlewares...))
+	mux.Handle(endpoint.Ready, xmiddleware.Chain(readyHandler, healthMiddlewares...))
+
 	httpServer := &http.Server{
 		Addr:         cfg.Server.Address,
 		Handler:      mux,
-		TLSConfig:    tlsConfig,
+		TLSConfig:    newTLSConfig(cfg.Server, certs, acmeManager),
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: WriteTimeout,
 		IdleTimeout:  60 * time.Second,
 		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
 	}
 
 	return &Server{
-		httpServer: httpServer,
-		logger:     logger,
+		httpServer:    httpServer,
+		logger:        logger,
+		logLevel:      logLevel,
+		acmeServer:    newACMEHTTPServer(cfg.Server, acmeManager, logger),
+		cfg:           cfg,
+		certs:         certs,
+		cache:         cacheInstance,
+		avatarHandler: avatarHandler,
+		fetchClient:   fetchInstance,
+		discovery:     discovery,
+		service:       service,
+		listening:     listening,
+		cacheBackend:  cfg.Server.CacheBackend,
 	}, nil
 }
 
-// Start starts the Privytar server.
+// Start starts the Privytar server on the configured listener.
 func (s *Server) Start() error {
+	// The configuration is replaced when it is reloaded, so the settings the
+	// server starts with are read once.
+	cfg := s.cfg.Server
+
+	ln, err := listen(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	if s.acmeServer != nil {
+		acmeListener, err := net.Listen("tcp", s.acmeServer.Addr)
+		if err != nil {
+			_ = ln.Close()
+
+			return fmt.Errorf("failed to start ACME challenge server: %w", err)
+		}
+
+		go s.serveACME(acmeListener)
+	}
+
 	var (
 		sigint            = make(chan os.Signal, 1)
 		shutdownCompleted = make(chan struct{})
@@ -123,13 +228,22 @@ func (s *Server) Start() error {
 
 	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.reloadOnHangup(ctx)
+
+	if s.certs != nil {
+		go s.certs.Watch(ctx, cfg.TLS.ReloadInterval.Duration)
+	}
+
 	go func() {
 		<-sigint
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		if err := s.httpServer.Shutdown(ctx); err != nil {
+		if err := s.Stop(ctx); err != nil {
 			s.logger.LogAttrs(
 				ctx,
 				slog.LevelError,
@@ -141,7 +255,15 @@ func (s *Server) Start() error {
 		close(shutdownCompleted)
 	}()
 
-	if err := s.httpServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	s.listening.Store(true)
+
+	if cfg.Listener == config.ListenerTLS {
+		err = s.httpServer.ServeTLS(ln, "", "")
+	} else {
+		err = s.httpServer.Serve(ln)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
@@ -152,9 +274,184 @@ func (s *Server) Start() error {
 
 // Stop gracefully shuts down the Privytar server.
 func (s *Server) Stop(ctx context.Context) error {
+	// Report the server as not ready first, so load balancers stop sending
+	// it requests while it drains.
+	s.listening.Store(false)
+
+	if s.acmeServer != nil {
+		if err := s.acmeServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to shutdown ACME challenge server: %w", err)
+		}
+	}
+
 	if err := s.httpServer.Shutdown(ctx); err != nil {
 		return fmt.Errorf("failed to shutdown server: %w", err)
 	}
 
 	return nil
 }
+
+// serveACME answers ACME HTTP-01 challenges on the given listener until the
+// server is shut down.
+func (s *Server) serveACME(ln net.Listener) {
+	err := s.acmeServer.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.LogAttrs(
+			context.Background(),
+			slog.LevelError,
+			"ACME challenge server stopped",
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// newCertStore returns the store serving the TLS certificate of the server,
+// or nil if it doesn't serve HTTPS or its certificates are managed through
+// ACME.
+func newCertStore(cfg *config.Server, logger *slog.Logger) (*certstore.Store, error) {
+	if cfg.Listener != config.ListenerTLS || cfg.ACME != nil {
+		return nil, nil //nolint:nilnil // no certificate files to load
+	}
+
+	certs, err := certstore.New(cfg.TLS.Certificate, cfg.TLS.Key, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return certs, nil
+}
+
+// newTLSConfig returns the TLS configuration of the server, serving the
+// certificates obtained by the ACME manager if given, or the ones in the given
+// store otherwise. It returns nil if the server doesn't serve HTTPS.
+func newTLSConfig(cfg *config.Server, certs *certstore.Store, manager *autocert.Manager) *tls.Config {
+	if cfg.Listener != config.ListenerTLS {
+		return nil
+	}
+
+	var tlsConfig *tls.Config
+
+	if cfg.TLS.Version == "1.3" {
+		tlsConfig = xtls.ModernServerConfig()
+	}
+
+	if cfg.TLS.Version == "1.2" {
+		tlsConfig = xtls.IntermediateServerConfig()
+	}
+
+	if manager != nil {
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+
+		return tlsConfig
+	}
+
+	tlsConfig.GetCertificate = certs.GetCertificate
+
+	return tlsConfig
+}
+
+// newCache creates the cache backend selected in the server configuration.
+func newCache(cfg *config.Server) (cache.Backend, error) {
+	if cfg.CacheBackend == config.CacheBackendDisk {
+		diskCache, err := cache.NewDisk(cfg.CacheDirectory, newCacheOptions(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+
+		return diskCache, nil
+	}
+
+	return cache.NewWithOptions(newCacheOptions(cfg)), nil
+}
+
+// newCacheOptions returns the options of the cache backend selected in the
+// server configuration. The disk cache is bounded by its own maximum size and
+// isn't bounded by the number of entries.
+func newCacheOptions(cfg *config.Server) *cache.Options {
+	opts := &cache.Options{
+		Expiration:           cfg.CacheTTL,
+		StaleWhileRevalidate: cfg.CacheStaleWhileRevalidate,
+		StaleIfError:         cfg.CacheStaleIfError,
+		NotFoundExpiration:   cfg.CacheNotFoundTTL,
+		MaxBytes:             cfg.CacheMaxBytes,
+		MaxEntryBytes:        cfg.CacheMaxEntryBytes,
+		Capacity:             cfg.CacheCapacity,
+	}
+
+	if cfg.CacheBackend == config.CacheBackendDisk {
+		opts.MaxBytes = cfg.CacheDiskMaxBytes
+		opts.Capacity = 0
+	}
+
+	return opts
+}
+
+// newSettings returns the settings of the avatar handler defined in the
+// configuration, finding federated servers with the given discovery.
+func newSettings(cfg *config.Config, discovery *libravatar.Discovery) (*handler.Settings, error) {
+	upstreams, err := newUpstreams(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstreams: %w", err)
+	}
+
+	return &handler.Settings{
+		CacheControl: &handler.CacheControl{
+			MaxAge:         cfg.Server.CacheTTL.Duration,
+			NotFoundMaxAge: cfg.Server.CacheNotFoundTTL.Duration,
+			SharedMaxAge:   cfg.Server.CacheSharedMaxAge.Duration,
+			Immutable:      cfg.Server.CacheImmutable,
+		},
+		CustomDefaults: &handler.CustomDefaults{
+			Hosts:    cfg.Server.CustomDefaultHosts,
+			MaxBytes: cfg.Server.CustomDefaultMaxBytes,
+		},
+		Federation: newFederation(cfg.Server, discovery),
+		Homepage:   cfg.Service.Homepage,
+		BaseURL:    cfg.Service.BaseURL,
+		Upstreams:  upstreams,
+	}, nil
+}
+
+// newUpstreams creates the avatar providers listed in the server
+// configuration, in order.
+func newUpstreams(cfg *config.Server) ([]*upstream.Upstream, error) {
+	upstreams := make([]*upstream.Upstream, 0, len(cfg.Upstreams))
+
+	for _, u := range cfg.Upstreams {
+		instance, err := upstream.New(u.Name, u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+
+		upstreams = append(upstreams, instance)
+	}
+
+	return upstreams, nil
+}
+
+// newFederation returns the Libravatar federation settings of the avatar
+// handler, or nil if federation is disabled.
+func newFederation(cfg *config.Server, discovery *libravatar.Discovery) *handler.Federation {
+	if !cfg.LibravatarFederation {
+		return nil
+	}
+
+	return &handler.Federation{
+		Discovery: discovery,
+		MaxBytes:  cfg.LibravatarMaxBytes,
+	}
+}
+
+// serviceHeaders adds the privacy policy and terms of service headers of the
+// current service configuration to the response.
+func serviceHeaders(service *atomic.Pointer[config.Service], next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := service.Load()
+
+		w.Header().Set("Privacy-Policy", current.PrivacyPolicy)
+		w.Header().Set("Terms-Of-Service", current.TermsOfService)
+
+		next.ServeHTTP(w, r)
+	})
+}
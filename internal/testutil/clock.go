@@ -0,0 +1,37 @@
+// Package testutil provides helpers shared by the tests of other packages.
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a clock for tests that only moves when it is advanced, so
+// freshness can be tested without sleeping.
+type Clock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+// NewClock returns a clock set to a fixed time.
+func NewClock() *Clock {
+	return &Clock{
+		now: time.Date(2023, time.May, 16, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
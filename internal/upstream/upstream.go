@@ -0,0 +1,89 @@
+// Package upstream defines the avatar providers the service fetches avatars
+// from, such as Gravatar or a Libravatar-compatible server.
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"git.sr.ht/~jamesponddotco/xstd-go/xerrors"
+)
+
+// ErrInvalidTemplate is returned when the URL template of an upstream is
+// invalid.
+const ErrInvalidTemplate xerrors.Error = "invalid upstream URL template"
+
+// List of placeholders replaced in URL templates.
+const (
+	// PlaceholderHash is replaced by the hash of the email address.
+	PlaceholderHash string = "{hash}"
+
+	// PlaceholderQuery is replaced by the normalized query string.
+	PlaceholderQuery string = "{query}"
+)
+
+const (
+	// GravatarName is the name of the Gravatar upstream.
+	GravatarName string = "gravatar"
+
+	// GravatarTemplate is the URL template of Gravatar's avatars.
+	GravatarTemplate string = "https://secure.gravatar.com/avatar/{hash}?{query}"
+)
+
+// Upstream represents an avatar provider.
+type Upstream struct {
+	// Name identifies the upstream in logs.
+	Name string
+
+	// template is the URL template of the upstream's avatars.
+	template string
+}
+
+// New returns an upstream with the given name and URL template. The template
+// must be an absolute HTTP or HTTPS URL containing the {hash} placeholder. If
+// it doesn't contain the {query} placeholder, the query string is appended to
+// it.
+func New(name, template string) (*Upstream, error) {
+	if !strings.Contains(template, PlaceholderHash) {
+		return nil, fmt.Errorf("%w: missing %s placeholder", ErrInvalidTemplate, PlaceholderHash)
+	}
+
+	if !strings.Contains(template, PlaceholderQuery) {
+		separator := "?"
+		if strings.Contains(template, "?") {
+			separator = "&"
+		}
+
+		template += separator + PlaceholderQuery
+	}
+
+	u := &Upstream{
+		Name:     name,
+		template: template,
+	}
+
+	parsed, err := url.Parse(u.URL("0", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: must be an absolute HTTP or HTTPS URL", ErrInvalidTemplate)
+	}
+
+	return u, nil
+}
+
+// Gravatar returns the Gravatar upstream.
+func Gravatar() *Upstream {
+	return &Upstream{
+		Name:     GravatarName,
+		template: GravatarTemplate,
+	}
+}
+
+// URL returns the URL of the avatar for the given hash and query string.
+func (u *Upstream) URL(hash, query string) string {
+	return strings.NewReplacer(PlaceholderHash, hash, PlaceholderQuery, query).Replace(u.template)
+}
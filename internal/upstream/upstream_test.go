@@ -0,0 +1,86 @@
+package upstream_test
+
+import (
+	"errors"
+	"testing"
+
+	"git.sr.ht/~jamesponddotco/privytar/internal/upstream"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "Gravatar",
+			template: upstream.GravatarTemplate,
+			want:     "https://secure.gravatar.com/avatar/abc?s=96",
+		},
+		{
+			name:     "Missing query placeholder",
+			template: "https://avatars.example.com/{hash}",
+			want:     "https://avatars.example.com/abc?s=96",
+		},
+		{
+			name:     "Missing query placeholder with existing query",
+			template: "https://avatars.example.com/avatar?id={hash}",
+			want:     "https://avatars.example.com/avatar?id=abc&s=96",
+		},
+		{
+			name:     "Missing hash placeholder",
+			template: "https://avatars.example.com/avatar",
+			wantErr:  upstream.ErrInvalidTemplate,
+		},
+		{
+			name:     "Relative URL",
+			template: "/avatar/{hash}",
+			wantErr:  upstream.ErrInvalidTemplate,
+		},
+		{
+			name:     "Unsupported scheme",
+			template: "ftp://avatars.example.com/{hash}",
+			wantErr:  upstream.ErrInvalidTemplate,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := upstream.New("test", tt.template)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if uri := got.URL("abc", "s=96"); uri != tt.want {
+				t.Errorf("URL() = %q, want %q", uri, tt.want)
+			}
+		})
+	}
+}
+
+func TestGravatar(t *testing.T) {
+	t.Parallel()
+
+	got := upstream.Gravatar()
+
+	if got.Name != upstream.GravatarName {
+		t.Errorf("Gravatar().Name = %q, want %q", got.Name, upstream.GravatarName)
+	}
+
+	want := "https://secure.gravatar.com/avatar/abc?d=404"
+	if uri := got.URL("abc", "d=404"); uri != want {
+		t.Errorf("Gravatar().URL() = %q, want %q", uri, want)
+	}
+}